@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	"github.com/travis-ci/trvs-operator/pkg/trvssecret"
+)
+
+func (o *options) getTrvsSecret(name string) (*travisv1.TrvsSecret, error) {
+	return o.travisclient.TravisciV1().TrvsSecrets(o.namespace).Get(name, metav1.GetOptions{})
+}
+
+// secretOf returns the name of the secret ts currently generates.
+func secretOf(ts *travisv1.TrvsSecret) string {
+	if ts.Status.CurrentSecret != "" {
+		return ts.Status.CurrentSecret
+	}
+	return ts.Name
+}
+
+// state sums up the status of ts in a word.
+func state(ts *travisv1.TrvsSecret) string {
+	for _, c := range ts.Status.Conditions {
+		if c.Type == travisv1.TrvsSecretForbidden && c.Status == v1.ConditionTrue {
+			return "Forbidden"
+		}
+	}
+	for _, c := range ts.Status.Conditions {
+		if c.Type == travisv1.TrvsSecretDrifted && c.Status == v1.ConditionTrue {
+			return "Drifted"
+		}
+	}
+
+	switch {
+	case ts.Status.Suspended:
+		return "Suspended"
+	case ts.Status.Revision == "":
+		return "Pending"
+	case ts.Status.PinnedRevision != "":
+		return "Pinned"
+	default:
+		return "Synced"
+	}
+}
+
+func keychainOf(ts *travisv1.TrvsSecret) string {
+	if ts.Spec.IsPro {
+		return "com"
+	}
+	return "org"
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
+
+// age formats how long ago t was the way kubectl does, or "<never>" if t is
+// not set.
+func age(t *metav1.Time) string {
+	if t == nil || t.IsZero() {
+		return "<never>"
+	}
+
+	d := time.Since(t.Time)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
+
+func status(o *options, args []string) error {
+	if len(args) == 1 {
+		ts, err := o.getTrvsSecret(args[0])
+		if err != nil {
+			return err
+		}
+		return describe(o, ts)
+	}
+
+	namespace := o.namespace
+	if o.allNamespaces {
+		namespace = ""
+	}
+
+	list, err := o.travisclient.TravisciV1().TrvsSecrets(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(list.Items, func(i, j int) bool {
+		a, b := list.Items[i], list.Items[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+
+	w := o.table()
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tSTATE\tSECRET\tREVISION\tKEYCHAIN\tCOMMIT\tUPDATED")
+	for i := range list.Items {
+		ts := &list.Items[i]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			ts.Namespace, ts.Name, state(ts), secretOf(ts), ts.Status.Revision,
+			keychainOf(ts), shortCommit(ts.Status.KeychainCommit), age(ts.Status.LastUpdateTime))
+	}
+	return w.Flush()
+}
+
+func describe(o *options, ts *travisv1.TrvsSecret) error {
+	w := o.table()
+	fmt.Fprintf(w, "Name:\t%s\n", ts.Name)
+	fmt.Fprintf(w, "Namespace:\t%s\n", ts.Namespace)
+	fmt.Fprintf(w, "State:\t%s\n", state(ts))
+	fmt.Fprintf(w, "Secret:\t%s\n", secretOf(ts))
+	fmt.Fprintf(w, "Revision:\t%s\n", ts.Status.Revision)
+	if ts.Status.PinnedRevision != "" {
+		fmt.Fprintf(w, "Pinned revision:\t%s\n", ts.Status.PinnedRevision)
+	}
+	fmt.Fprintf(w, "Keychain:\t%s\n", keychainOf(ts))
+	fmt.Fprintf(w, "Keychain commit:\t%s\n", ts.Status.KeychainCommit)
+	if t := ts.Status.LastUpdateTime; t != nil {
+		fmt.Fprintf(w, "Last update:\t%s (%s ago)\n", t.UTC().Format(time.RFC3339), age(t))
+	} else {
+		fmt.Fprintf(w, "Last update:\t<never>\n")
+	}
+	if ts.Status.LastResyncAt != "" {
+		fmt.Fprintf(w, "Last resync:\t%s\n", ts.Status.LastResyncAt)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(ts.Status.Conditions) == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(o.out, "Conditions:")
+	w = o.table()
+	fmt.Fprintln(w, "  TYPE\tSTATUS\tREASON\tMESSAGE")
+	for _, c := range ts.Status.Conditions {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", c.Type, c.Status, c.Reason, c.Message)
+	}
+	return w.Flush()
+}
+
+func keys(o *options, args []string) error {
+	ts, err := o.getTrvsSecret(args[0])
+	if err != nil {
+		return err
+	}
+
+	secret, err := o.kubeclient.CoreV1().Secrets(ts.Namespace).Get(secretOf(ts), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	managed := make(map[string]bool)
+	for _, k := range strings.Split(secret.Annotations[trvssecret.ManagedKeysAnnotation], ",") {
+		managed[k] = true
+	}
+
+	names := make([]string, 0, len(secret.Data))
+	for k := range secret.Data {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	w := o.table()
+	fmt.Fprintln(w, "KEY\tVALUE\tBYTES\tMANAGED")
+	for _, k := range names {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%t\n", k, "********", len(secret.Data[k]), managed[k])
+	}
+	return w.Flush()
+}
+
+func workloads(o *options, args []string) error {
+	ts, err := o.getTrvsSecret(args[0])
+	if err != nil {
+		return err
+	}
+
+	// the workloads may still use any secret ts ever generated
+	names := map[string]bool{ts.Name: true, secretOf(ts): true}
+	history, err := o.history(ts)
+	if err != nil {
+		return err
+	}
+	for _, s := range history {
+		names[s.Name] = true
+	}
+
+	type workload struct {
+		kind string
+		meta metav1.ObjectMeta
+		spec *v1.PodSpec
+	}
+	var all []workload
+
+	apps := o.kubeclient.AppsV1()
+	deployments, err := apps.Deployments(ts.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range deployments.Items {
+		d := &deployments.Items[i]
+		all = append(all, workload{"Deployment", d.ObjectMeta, &d.Spec.Template.Spec})
+	}
+
+	statefulSets, err := apps.StatefulSets(ts.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range statefulSets.Items {
+		s := &statefulSets.Items[i]
+		all = append(all, workload{"StatefulSet", s.ObjectMeta, &s.Spec.Template.Spec})
+	}
+
+	daemonSets, err := apps.DaemonSets(ts.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range daemonSets.Items {
+		d := &daemonSets.Items[i]
+		all = append(all, workload{"DaemonSet", d.ObjectMeta, &d.Spec.Template.Spec})
+	}
+
+	w := o.table()
+	fmt.Fprintln(w, "KIND\tNAME\tFOLLOWS\tUSES")
+	for _, wl := range all {
+		follows := trvssecret.FollowsTrvsSecret(wl.meta, ts)
+		var uses []string
+		for name := range names {
+			if trvssecret.ReferencesSecrets(wl.spec, map[string]bool{name: true}) {
+				uses = append(uses, name)
+			}
+		}
+		if !follows && len(uses) == 0 {
+			continue
+		}
+
+		sort.Strings(uses)
+		fmt.Fprintf(w, "%s\t%s\t%t\t%s\n", wl.kind, wl.meta.Name, follows, strings.Join(uses, ","))
+	}
+	return w.Flush()
+}
+
+func drift(o *options, args []string) error {
+	ts, err := o.getTrvsSecret(args[0])
+	if err != nil {
+		return err
+	}
+
+	secret, err := o.kubeclient.CoreV1().Secrets(ts.Namespace).Get(secretOf(ts), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if ts.Spec.Immutable {
+		return immutableDrift(o, ts, secret)
+	}
+
+	written := secret.Annotations[trvssecret.DataHashAnnotation]
+	switch {
+	case written == "":
+		fmt.Fprintf(o.out, "Secret %s has no record of what the operator wrote to it, so drift can't be checked\n", secret.Name)
+		return nil
+	case written == trvssecret.DataHash(secret.Data):
+		fmt.Fprintf(o.out, "Secret %s matches what the operator last wrote\n", secret.Name)
+		return nil
+	}
+
+	fmt.Fprintf(o.out, "Secret %s was edited outside of the operator (drift policy: %s)\n", secret.Name, driftPolicy(ts))
+
+	// the revision kept in the history, if any, tells which keys changed
+	revision, err := o.kubeclient.CoreV1().Secrets(ts.Namespace).Get(trvssecret.RevisionSecretName(ts, ts.Status.Revision), metav1.GetOptions{})
+	if err != nil || ts.Status.Revision == "" || !metav1.IsControlledBy(revision, ts) {
+		return nil
+	}
+
+	var changed []string
+	for k, v := range revision.Data {
+		if current, ok := secret.Data[k]; !ok || !bytes.Equal(current, v) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range secret.Data {
+		if _, ok := revision.Data[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+
+	if len(changed) > 0 {
+		fmt.Fprintf(o.out, "Changed keys: %s\n", strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// immutableDrift checks the current secret of an immutable TrvsSecret. It is
+// a revision secret, named after the hash of the data it was created with, so
+// there is no data hash annotation, and no copy of that data to tell which
+// keys changed. The drift policy doesn't apply to it either.
+func immutableDrift(o *options, ts *travisv1.TrvsSecret, secret *v1.Secret) error {
+	rev := strings.TrimPrefix(secret.Name, ts.Name+"-")
+	if secret.Name != trvssecret.RevisionSecretName(ts, rev) {
+		fmt.Fprintf(o.out, "Secret %s is not a revision of trvssecret/%s, so drift can't be checked\n", secret.Name, ts.Name)
+		return nil
+	}
+
+	if trvssecret.Revision(secret.Data) == rev {
+		fmt.Fprintf(o.out, "Secret %s matches revision %s\n", secret.Name, rev)
+		return nil
+	}
+
+	fmt.Fprintf(o.out, "Secret %s was edited outside of the operator and no longer holds revision %s\n", secret.Name, rev)
+	return nil
+}
+
+func driftPolicy(ts *travisv1.TrvsSecret) travisv1.DriftPolicy {
+	if ts.Spec.DriftPolicy == "" {
+		return travisv1.DriftPolicyHeal
+	}
+	return ts.Spec.DriftPolicy
+}
+
+// history returns the revision secrets of ts, newest first.
+func (o *options) history(ts *travisv1.TrvsSecret) ([]v1.Secret, error) {
+	selector := labels.SelectorFromSet(labels.Set{trvssecret.HistoryOfLabel: ts.Name})
+	list, err := o.kubeclient.CoreV1().Secrets(ts.Namespace).List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	// a TrvsSecret recreated under the same name doesn't own the revisions of
+	// the one it replaced
+	var owned []v1.Secret
+	for i := range list.Items {
+		if metav1.IsControlledBy(&list.Items[i], ts) {
+			owned = append(owned, list.Items[i])
+		}
+	}
+
+	sort.Slice(owned, func(i, j int) bool {
+		return owned[j].CreationTimestamp.Before(&owned[i].CreationTimestamp)
+	})
+	return owned, nil
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/travis-ci/trvs-operator/internal/kubetest"
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	"github.com/travis-ci/trvs-operator/pkg/trvssecret"
+)
+
+var generated = map[string][]byte{"API_KEY": []byte("key"), "DATABASE_URL": []byte("postgres://db")}
+
+func newTrvsSecret(name string, uid types.UID) *travisv1.TrvsSecret {
+	return &travisv1.TrvsSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: uid},
+		Spec:       travisv1.TrvsSecretSpec{App: name, Environment: "production"},
+		Status: travisv1.TrvsSecretStatus{
+			Revision:       trvssecret.Revision(generated),
+			KeychainCommit: "0123456789abcdef",
+		},
+	}
+}
+
+// newSecret returns the secret the operator writes for ts, holding data
+// although it last wrote generated.
+func newSecret(ts *travisv1.TrvsSecret, data map[string][]byte) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ts.Name,
+			Namespace: ts.Namespace,
+			Annotations: map[string]string{
+				trvssecret.DataHashAnnotation:    trvssecret.DataHash(generated),
+				trvssecret.ManagedKeysAnnotation: "API_KEY,DATABASE_URL",
+			},
+		},
+		Data: data,
+	}
+}
+
+// newRevisionSecret returns a revision secret of ts controlled by owner.
+func newRevisionSecret(ts *travisv1.TrvsSecret, owner types.UID) *v1.Secret {
+	isController := true
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      trvssecret.RevisionSecretName(ts, ts.Status.Revision),
+			Namespace: ts.Namespace,
+			Labels:    map[string]string{trvssecret.HistoryOfLabel: ts.Name},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: travisv1.SchemeGroupVersion.String(),
+				Kind:       "TrvsSecret",
+				Name:       ts.Name,
+				UID:        owner,
+				Controller: &isController,
+			}},
+		},
+		Data: generated,
+	}
+}
+
+func newDeployment(name string, annotations map[string]string, secret string) *appsv1.Deployment {
+	d := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations}}
+	if secret != "" {
+		d.Spec.Template.Spec.Containers = []v1.Container{{
+			Name: "app",
+			EnvFrom: []v1.EnvFromSource{{
+				SecretRef: &v1.SecretEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: secret}},
+			}},
+		}}
+	}
+	return d
+}
+
+func withData(data map[string][]byte, k, v string) map[string][]byte {
+	changed := make(map[string][]byte)
+	for k, v := range data {
+		changed[k] = v
+	}
+	if v == "" {
+		delete(changed, k)
+	} else {
+		changed[k] = []byte(v)
+	}
+	return changed
+}
+
+type inspectTest struct {
+	desc   string
+	args   []string
+	kube   []runtime.Object
+	travis []runtime.Object
+	want   []string
+
+	// unordered is set when the lines after the header come in the order
+	// the fake clientset lists objects in, which is random
+	unordered bool
+}
+
+// runInspectTests runs cmd against fake clientsets holding the objects of
+// each test, and compares its output line by line, ignoring how columns are
+// padded.
+func runInspectTests(t *testing.T, cmd func(*options, []string) error, tests []inspectTest) {
+	for _, test := range tests {
+		var out bytes.Buffer
+		o := &options{
+			namespace:    "default",
+			out:          &out,
+			kubeclient:   kubetest.NewClientset(test.kube...),
+			travisclient: kubetest.NewTravisClientset(test.travis...),
+		}
+
+		if err := cmd(o, test.args); err != nil {
+			t.Errorf("%s: %v", test.desc, err)
+			continue
+		}
+
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			got = append(got, strings.Join(strings.Fields(line), " "))
+		}
+		if test.unordered {
+			sort.Strings(got[1:])
+		}
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.desc, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	app := newTrvsSecret("app", "uid-app")
+	rev := app.Status.Revision
+
+	paused := newTrvsSecret("paused", "uid-paused")
+	paused.Status.Suspended = true
+
+	pending := newTrvsSecret("pending", "uid-pending")
+	pending.Status = travisv1.TrvsSecretStatus{}
+
+	pinned := newTrvsSecret("pinned", "uid-pinned")
+	pinned.Spec.IsPro = true
+	pinned.Status.PinnedRevision = "abc"
+	pinned.Status.CurrentSecret = "pinned-abc"
+
+	forbidden := newTrvsSecret("forbidden", "uid-forbidden")
+	forbidden.Status.Conditions = []travisv1.TrvsSecretCondition{
+		{Type: travisv1.TrvsSecretForbidden, Status: v1.ConditionTrue, Reason: "Forbidden", Message: "not allowed"},
+	}
+
+	other := newTrvsSecret("other", "uid-other")
+	other.Namespace = "other"
+
+	runInspectTests(t, status, []inspectTest{
+		{
+			desc:   "lists the TrvsSecrets of the namespace",
+			travis: []runtime.Object{pinned, app, paused, pending, other},
+			want: []string{
+				"NAMESPACE NAME STATE SECRET REVISION KEYCHAIN COMMIT UPDATED",
+				"default app Synced app " + rev + " org 0123456 <never>",
+				"default paused Suspended paused " + rev + " org 0123456 <never>",
+				"default pending Pending pending org <never>",
+				"default pinned Pinned pinned-abc " + rev + " com 0123456 <never>",
+			},
+		},
+		{
+			desc:   "describes a TrvsSecret",
+			args:   []string{"forbidden"},
+			travis: []runtime.Object{app, forbidden},
+			want: []string{
+				"Name: forbidden",
+				"Namespace: default",
+				"State: Forbidden",
+				"Secret: forbidden",
+				"Revision: " + rev,
+				"Keychain: org",
+				"Keychain commit: 0123456789abcdef",
+				"Last update: <never>",
+				"Conditions:",
+				"TYPE STATUS REASON MESSAGE",
+				"Forbidden True Forbidden not allowed",
+			},
+		},
+	})
+}
+
+func TestKeys(t *testing.T) {
+	app := newTrvsSecret("app", "uid-app")
+
+	pinned := newTrvsSecret("pinned", "uid-pinned")
+	pinned.Status.CurrentSecret = "pinned-abc"
+	pinnedSecret := newSecret(pinned, generated)
+	pinnedSecret.Name = "pinned-abc"
+
+	runInspectTests(t, keys, []inspectTest{
+		{
+			desc:   "masks values and marks the keys added by hand",
+			args:   []string{"app"},
+			travis: []runtime.Object{app},
+			kube:   []runtime.Object{newSecret(app, withData(generated, "EXTRA", "added by hand"))},
+			want: []string{
+				"KEY VALUE BYTES MANAGED",
+				"API_KEY ******** 3 true",
+				"DATABASE_URL ******** 13 true",
+				"EXTRA ******** 13 false",
+			},
+		},
+		{
+			desc:   "reads the current secret",
+			args:   []string{"pinned"},
+			travis: []runtime.Object{pinned},
+			kube:   []runtime.Object{newSecret(pinned, map[string][]byte{"API_KEY": []byte("old")}), pinnedSecret},
+			want: []string{
+				"KEY VALUE BYTES MANAGED",
+				"API_KEY ******** 3 true",
+				"DATABASE_URL ******** 13 true",
+			},
+		},
+	})
+}
+
+func TestDrift(t *testing.T) {
+	app := newTrvsSecret("app", "uid-app")
+	revision := newRevisionSecret(app, app.UID)
+
+	unrecorded := newSecret(app, generated)
+	delete(unrecorded.Annotations, trvssecret.DataHashAnnotation)
+
+	edited := withData(withData(withData(generated, "API_KEY", "changed"), "DATABASE_URL", ""), "EXTRA", "added by hand")
+
+	immutable := newTrvsSecret("app", "uid-app")
+	immutable.Spec.Immutable = true
+	immutable.Status.CurrentSecret = revision.Name
+	editedRevision := newRevisionSecret(app, app.UID)
+	editedRevision.Data = edited
+
+	runInspectTests(t, drift, []inspectTest{
+		{
+			desc:   "secret matches",
+			args:   []string{"app"},
+			travis: []runtime.Object{app},
+			kube:   []runtime.Object{newSecret(app, generated), revision},
+			want:   []string{"Secret app matches what the operator last wrote"},
+		},
+		{
+			desc:   "secret has no data hash",
+			args:   []string{"app"},
+			travis: []runtime.Object{app},
+			kube:   []runtime.Object{unrecorded},
+			want:   []string{"Secret app has no record of what the operator wrote to it, so drift can't be checked"},
+		},
+		{
+			desc:   "reports changed, removed and added keys",
+			args:   []string{"app"},
+			travis: []runtime.Object{app},
+			kube:   []runtime.Object{newSecret(app, edited), revision},
+			want: []string{
+				"Secret app was edited outside of the operator (drift policy: Heal)",
+				"Changed keys: API_KEY, DATABASE_URL, EXTRA",
+			},
+		},
+		{
+			desc:   "ignores revisions of a TrvsSecret of the same name",
+			args:   []string{"app"},
+			travis: []runtime.Object{app},
+			kube:   []runtime.Object{newSecret(app, edited), newRevisionSecret(app, "uid-old")},
+			want:   []string{"Secret app was edited outside of the operator (drift policy: Heal)"},
+		},
+		{
+			desc:   "immutable secret matches its revision",
+			args:   []string{"app"},
+			travis: []runtime.Object{immutable},
+			kube:   []runtime.Object{revision},
+			want:   []string{"Secret " + revision.Name + " matches revision " + app.Status.Revision},
+		},
+		{
+			desc:   "immutable secret was edited",
+			args:   []string{"app"},
+			travis: []runtime.Object{immutable},
+			kube:   []runtime.Object{editedRevision},
+			want:   []string{"Secret " + revision.Name + " was edited outside of the operator and no longer holds revision " + app.Status.Revision},
+		},
+	})
+}
+
+func TestWorkloads(t *testing.T) {
+	app := newTrvsSecret("app", "uid-app")
+	revision := newRevisionSecret(app, app.UID)
+
+	old := newRevisionSecret(app, "uid-old")
+	old.Name = "app-old"
+
+	follows := map[string]string{trvssecret.WorkloadSecretsAnnotation: "other, app"}
+
+	statefulSet := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"}}
+	statefulSet.Spec.Template.Spec.Volumes = []v1.Volume{{
+		Name:         "secrets",
+		VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: "app"}},
+	}}
+
+	runInspectTests(t, workloads, []inspectTest{
+		{
+			desc:   "lists workloads following or using the secrets of a TrvsSecret",
+			args:   []string{"app"},
+			travis: []runtime.Object{app},
+			kube: []runtime.Object{
+				revision, old, statefulSet,
+				newDeployment("web", follows, revision.Name),
+				newDeployment("worker", nil, revision.Name),
+				newDeployment("follower", follows, ""),
+				newDeployment("stale", nil, old.Name),
+				newDeployment("unrelated", nil, "other"),
+			},
+			want: []string{
+				"KIND NAME FOLLOWS USES",
+				"Deployment follower true",
+				"Deployment web true " + revision.Name,
+				"Deployment worker false " + revision.Name,
+				"StatefulSet db false app",
+			},
+			unordered: true,
+		},
+	})
+}
@@ -0,0 +1,164 @@
+// kubectl-trvs inspects and operates TrvsSecrets. Installed on the PATH, it is
+// run by kubectl as `kubectl trvs`.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	travisclientset "github.com/travis-ci/trvs-operator/pkg/client/clientset/versioned"
+)
+
+type command struct {
+	name string
+	args string
+	help string
+	min  int
+	max  int
+	run  func(o *options, args []string) error
+}
+
+var commands = []command{
+	{"status", "[NAME]", "Show the sync status of TrvsSecrets, or the details of one", 0, 1, status},
+	{"keys", "NAME", "List the keys of the secret of a TrvsSecret, with masked values", 1, 1, keys},
+	{"workloads", "NAME", "List the workloads using the secrets of a TrvsSecret", 1, 1, workloads},
+	{"drift", "NAME", "Check whether the secret of a TrvsSecret was edited outside of the operator", 1, 1, drift},
+	{"resync", "NAME", "Fetch the keychain and regenerate a TrvsSecret right away", 1, 1, resync},
+	{"pause", "NAME", "Stop updating the secret of a TrvsSecret", 1, 1, pause},
+	{"resume", "NAME", "Resume updating the secret of a TrvsSecret", 1, 1, resume},
+	{"rollback", "NAME [REVISION]", "Pin a TrvsSecret to a revision, or list its revisions", 1, 2, rollback},
+}
+
+// options holds the flags and clients shared by every command.
+type options struct {
+	kubeconfig    string
+	context       string
+	namespace     string
+	allNamespaces bool
+	clear         bool
+
+	out          io.Writer
+	kubeclient   kubernetes.Interface
+	travisclient travisclientset.Interface
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage()
+		return nil
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == args[0] {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		usage()
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	o := &options{out: os.Stdout}
+	fs := flag.NewFlagSet("kubectl trvs "+cmd.name, flag.ContinueOnError)
+	fs.StringVar(&o.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file to use")
+	fs.StringVar(&o.context, "context", "", "The kubeconfig context to use")
+	fs.StringVar(&o.namespace, "namespace", "", "The namespace of the TrvsSecret")
+	fs.StringVar(&o.namespace, "n", "", "Shorthand for -namespace")
+	if cmd.name == "status" {
+		fs.BoolVar(&o.allNamespaces, "all-namespaces", false, "List TrvsSecrets in every namespace")
+		fs.BoolVar(&o.allNamespaces, "A", false, "Shorthand for -all-namespaces")
+	}
+	if cmd.name == "rollback" {
+		fs.BoolVar(&o.clear, "clear", false, "Unpin the TrvsSecret, going back to its latest data")
+	}
+
+	positional, err := parseInterspersed(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	if len(positional) < cmd.min || len(positional) > cmd.max {
+		return fmt.Errorf("usage: kubectl trvs %s %s", cmd.name, cmd.args)
+	}
+
+	if err := o.setupClients(); err != nil {
+		return err
+	}
+
+	return cmd.run(o, positional)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Inspect and operate TrvsSecrets.\n\nUsage: kubectl trvs COMMAND [flags]\n\nCommands:")
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", c.name, c.args, c.help)
+	}
+	w.Flush()
+	fmt.Fprintln(os.Stderr, "\nEvery command takes -n NAMESPACE, -context and -kubeconfig.")
+}
+
+// parseInterspersed parses flags that come before, between or after the
+// positional arguments, the way kubectl does, and returns the positional ones.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func (o *options) setupClients() error {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = o.kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: o.context}
+	config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+
+	if o.namespace == "" {
+		ns, _, err := config.Namespace()
+		if err != nil {
+			return err
+		}
+		o.namespace = ns
+	}
+
+	cfg, err := config.ClientConfig()
+	if err != nil {
+		return err
+	}
+
+	if o.kubeclient, err = kubernetes.NewForConfig(cfg); err != nil {
+		return err
+	}
+
+	o.travisclient, err = travisclientset.NewForConfig(cfg)
+	return err
+}
+
+// table writes aligned columns to the output.
+func (o *options) table() *tabwriter.Writer {
+	return tabwriter.NewWriter(o.out, 0, 4, 3, ' ', 0)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/travis-ci/trvs-operator/pkg/trvssecret"
+)
+
+// patch applies a JSON merge patch to a TrvsSecret. Setting a field to nil
+// removes it.
+func (o *options) patch(name string, patch map[string]interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	_, err = o.travisclient.TravisciV1().TrvsSecrets(o.namespace).Patch(name, types.MergePatchType, data)
+	return err
+}
+
+func resync(o *options, args []string) error {
+	at := time.Now().UTC().Format(time.RFC3339)
+	err := o.patch(args[0], map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				trvssecret.ResyncAtAnnotation: at,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(o.out, "trvssecret/%s resync requested at %s\n", args[0], at)
+	return nil
+}
+
+func pause(o *options, args []string) error {
+	if err := o.patch(args[0], map[string]interface{}{
+		"spec": map[string]interface{}{"suspend": true},
+	}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(o.out, "trvssecret/%s paused\n", args[0])
+	return nil
+}
+
+func resume(o *options, args []string) error {
+	if err := o.patch(args[0], map[string]interface{}{
+		"spec": map[string]interface{}{"suspend": nil},
+	}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(o.out, "trvssecret/%s resumed\n", args[0])
+	return nil
+}
+
+func rollback(o *options, args []string) error {
+	ts, err := o.getTrvsSecret(args[0])
+	if err != nil {
+		return err
+	}
+
+	if o.clear {
+		if err := o.patch(ts.Name, map[string]interface{}{
+			"spec": map[string]interface{}{"rollbackTo": nil},
+		}); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(o.out, "trvssecret/%s unpinned\n", ts.Name)
+		return nil
+	}
+
+	history, err := o.history(ts)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 1 {
+		if len(history) == 0 {
+			fmt.Fprintf(o.out, "trvssecret/%s has no revisions; set spec.historyLimit to keep some\n", ts.Name)
+			return nil
+		}
+
+		w := o.table()
+		fmt.Fprintln(w, "REVISION\tKEYCHAIN COMMIT\tCREATED\t")
+		for i := range history {
+			s := &history[i]
+			rev := strings.TrimPrefix(s.Name, ts.Name+"-")
+
+			var marks []string
+			if rev == ts.Status.Revision {
+				marks = append(marks, "current")
+			}
+			if rev == ts.Status.PinnedRevision {
+				marks = append(marks, "pinned")
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s ago\t%s\n", rev, shortCommit(s.Annotations[trvssecret.KeychainCommitAnnotation]),
+				age(&s.CreationTimestamp), strings.Join(marks, ","))
+		}
+		return w.Flush()
+	}
+
+	rev := args[1]
+	found := false
+	for _, s := range history {
+		if s.Name == trvssecret.RevisionSecretName(ts, rev) {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("trvssecret/%s has no revision %q", ts.Name, rev)
+	}
+
+	if err := o.patch(ts.Name, map[string]interface{}{
+		"spec": map[string]interface{}{"rollbackTo": rev},
+	}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(o.out, "trvssecret/%s pinned to revision %s\n", ts.Name, rev)
+	return nil
+}
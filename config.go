@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/travis-ci/trvs-operator/pkg/backoff"
+	"github.com/travis-ci/trvs-operator/pkg/gitrepo"
+	"github.com/travis-ci/trvs-operator/pkg/logging"
+	"github.com/travis-ci/trvs-operator/pkg/notify"
+)
+
+// configVersion is the only version of the configuration file format so far.
+const configVersion = 1
+
+// Config is the operator's configuration file. Every setting corresponds to a
+// command line flag, and flags given on the command line take precedence over
+// the file. Settings that are left out keep the flag's default.
+type Config struct {
+	Version int `yaml:"version"`
+
+	Trvs       TrvsConfig       `yaml:"trvs"`
+	Queue      QueueConfig      `yaml:"queue"`
+	Keychains  KeychainsConfig  `yaml:"keychains"`
+	Git        GitConfig        `yaml:"git"`
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+	Sweep      SweepConfig      `yaml:"sweep"`
+	Policy     PolicyConfig     `yaml:"policy"`
+	Log        LogConfig        `yaml:"log"`
+	Audit      AuditConfig      `yaml:"audit"`
+	HTTP       HTTPConfig       `yaml:"http"`
+
+	Notifications NotificationsConfig `yaml:"notifications"`
+
+	SecretsDir          string `yaml:"secretsDir"`
+	CacheDir            string `yaml:"cacheDir"`
+	Workers             *int   `yaml:"workers"`
+	ShutdownGracePeriod string `yaml:"shutdownGracePeriod"`
+}
+
+type TrvsConfig struct {
+	URL         string   `yaml:"url"`
+	Auth        string   `yaml:"auth"`
+	KnownHosts  []string `yaml:"knownHosts"`
+	Dir         string   `yaml:"dir"`
+	Concurrency *int     `yaml:"concurrency"`
+}
+
+type QueueConfig struct {
+	RetryBaseDelay string   `yaml:"retryBaseDelay"`
+	RetryMaxDelay  string   `yaml:"retryMaxDelay"`
+	QPS            *float64 `yaml:"qps"`
+	Burst          *int     `yaml:"burst"`
+}
+
+type KeychainsConfig struct {
+	Dir        string         `yaml:"dir"`
+	SyncPeriod string         `yaml:"syncPeriod"`
+	Org        KeychainConfig `yaml:"org"`
+	Com        KeychainConfig `yaml:"com"`
+}
+
+type KeychainConfig struct {
+	URL        string   `yaml:"url"`
+	Auth       string   `yaml:"auth"`
+	KnownHosts []string `yaml:"knownHosts"`
+}
+
+type GitConfig struct {
+	Branch        string `yaml:"branch"`
+	CloneDepth    *int   `yaml:"cloneDepth"`
+	SSHKnownHosts string `yaml:"sshKnownHosts"`
+	GitHubAPIURL  string `yaml:"githubAPIURL"`
+}
+
+type KubernetesConfig struct {
+	SyncPeriod string   `yaml:"syncPeriod"`
+	Namespaces []string `yaml:"namespaces"`
+}
+
+type SweepConfig struct {
+	Period string `yaml:"period"`
+	DryRun *bool  `yaml:"dryRun"`
+}
+
+type PolicyConfig struct {
+	Required *bool `yaml:"required"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+type AuditConfig struct {
+	Log         string `yaml:"log"`
+	WebhookURL  string `yaml:"webhookURL"`
+	HashKeyFile string `yaml:"hashKeyFile"`
+}
+
+type HTTPConfig struct {
+	MetricsAddr string        `yaml:"metricsAddr"`
+	Webhook     WebhookConfig `yaml:"webhook"`
+}
+
+type WebhookConfig struct {
+	Addr     string `yaml:"addr"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+type NotificationsConfig struct {
+	Events           []string         `yaml:"events"`
+	FailureThreshold *int             `yaml:"failureThreshold"`
+	DedupWindow      string           `yaml:"dedupWindow"`
+	Webhook          NotifyHookConfig `yaml:"webhook"`
+	Slack            NotifyHookConfig `yaml:"slack"`
+	SMTP             NotifySMTPConfig `yaml:"smtp"`
+}
+
+type NotifyHookConfig struct {
+	URL        string   `yaml:"url"`
+	Namespaces []string `yaml:"namespaces"`
+}
+
+type NotifySMTPConfig struct {
+	Addr       string   `yaml:"addr"`
+	From       string   `yaml:"from"`
+	To         []string `yaml:"to"`
+	Username   string   `yaml:"username"`
+	Namespaces []string `yaml:"namespaces"`
+}
+
+// reloadableFlags can be changed while the operator is running. Changes to
+// anything else in the configuration file need a restart.
+var reloadableFlags = map[string]bool{
+	"log-level":      true,
+	"log-format":     true,
+	"require-policy": true,
+	"sweep-period":   true,
+	"sweep-dry-run":  true,
+
+	"audit-log":         true,
+	"audit-webhook-url": true,
+
+	"notify-events":             true,
+	"notify-failure-threshold":  true,
+	"notify-dedup-window":       true,
+	"notify-webhook-url":        true,
+	"notify-webhook-namespaces": true,
+	"notify-slack-url":          true,
+	"notify-slack-namespaces":   true,
+	"notify-smtp-addr":          true,
+	"notify-smtp-from":          true,
+	"notify-smtp-to":            true,
+	"notify-smtp-username":      true,
+	"notify-smtp-namespaces":    true,
+}
+
+// LoadConfig reads and validates a configuration file. Unknown settings are
+// rejected, so typos don't go unnoticed.
+func LoadConfig(file string) (*Config, []byte, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := parseConfig(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	return c, b, nil
+}
+
+func parseConfig(b []byte) (*Config, error) {
+	var c Config
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// Validate checks every setting, reporting all problems at once.
+func (c *Config) Validate() error {
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Version != configVersion {
+		fail("unsupported version %d, expected %d", c.Version, configVersion)
+	}
+
+	for _, d := range []struct{ name, value string }{
+		{"keychains.syncPeriod", c.Keychains.SyncPeriod},
+		{"kubernetes.syncPeriod", c.Kubernetes.SyncPeriod},
+		{"sweep.period", c.Sweep.Period},
+		{"shutdownGracePeriod", c.ShutdownGracePeriod},
+		{"queue.retryBaseDelay", c.Queue.RetryBaseDelay},
+		{"queue.retryMaxDelay", c.Queue.RetryMaxDelay},
+		{"notifications.dedupWindow", c.Notifications.DedupWindow},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v < 0 {
+			fail("%s: invalid duration %q", d.name, d.value)
+		}
+	}
+
+	for _, a := range []struct{ name, method string }{
+		{"trvs.auth", c.Trvs.Auth},
+		{"keychains.org.auth", c.Keychains.Org.Auth},
+		{"keychains.com.auth", c.Keychains.Com.Auth},
+	} {
+		switch a.method {
+		case "", gitrepo.AuthSSH, gitrepo.AuthToken, gitrepo.AuthGitHubApp:
+		default:
+			fail("%s: unknown auth method %q", a.name, a.method)
+		}
+	}
+
+	for _, k := range []struct {
+		name  string
+		lines []string
+	}{
+		{"trvs.knownHosts", c.Trvs.KnownHosts},
+		{"keychains.org.knownHosts", c.Keychains.Org.KnownHosts},
+		{"keychains.com.knownHosts", c.Keychains.Com.KnownHosts},
+	} {
+		for i, line := range k.lines {
+			if _, _, _, _, _, err := ssh.ParseKnownHosts([]byte(line)); err != nil {
+				fail("%s[%d]: %v", k.name, i, err)
+			}
+		}
+	}
+
+	if c.Workers != nil && *c.Workers < 1 {
+		fail("workers: must be at least 1")
+	}
+
+	if c.Trvs.Concurrency != nil && *c.Trvs.Concurrency < 1 {
+		fail("trvs.concurrency: must be at least 1")
+	}
+
+	if c.Queue.QPS != nil && *c.Queue.QPS <= 0 {
+		fail("queue.qps: must be positive")
+	}
+
+	if c.Queue.Burst != nil && *c.Queue.Burst < 1 {
+		fail("queue.burst: must be at least 1")
+	}
+
+	if c.Git.CloneDepth != nil && *c.Git.CloneDepth < 0 {
+		fail("git.cloneDepth: must not be negative")
+	}
+
+	for _, e := range c.Notifications.Events {
+		if !notify.IsEvent(e) {
+			fail("notifications.events: unknown event %q", e)
+		}
+	}
+
+	if c.Notifications.FailureThreshold != nil && *c.Notifications.FailureThreshold < 1 {
+		fail("notifications.failureThreshold: must be at least 1")
+	}
+
+	if c.Log.Level != "" {
+		if _, err := logging.ParseLevels(c.Log.Level); err != nil {
+			fail("log.level: %v", err)
+		}
+	}
+
+	switch c.Log.Format {
+	case "", "text", "json":
+	default:
+		fail("log.format: unknown format %q", c.Log.Format)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// flagValues maps the settings in the file to the flags they correspond to.
+// Settings that aren't in the file are left out.
+func (c *Config) flagValues() map[string]string {
+	values := make(map[string]string)
+	set := func(name, value string) {
+		if value != "" {
+			values[name] = value
+		}
+	}
+	setBool := func(name string, value *bool) {
+		if value != nil {
+			values[name] = strconv.FormatBool(*value)
+		}
+	}
+	// formatted the way the flag prints it, so values can be compared
+	setDuration := func(name, value string) {
+		if d, err := time.ParseDuration(value); err == nil {
+			values[name] = d.String()
+		}
+	}
+	setInt := func(name string, value *int) {
+		if value != nil {
+			values[name] = strconv.Itoa(*value)
+		}
+	}
+
+	set("trvs", c.Trvs.URL)
+	set("trvs-auth", c.Trvs.Auth)
+	set("trvs-known-hosts", strings.Join(c.Trvs.KnownHosts, "\n"))
+	set("trvs-dir", c.Trvs.Dir)
+	setInt("trvs-concurrency", c.Trvs.Concurrency)
+
+	setDuration("retry-base-delay", c.Queue.RetryBaseDelay)
+	setDuration("retry-max-delay", c.Queue.RetryMaxDelay)
+	if c.Queue.QPS != nil {
+		values["retry-qps"] = strconv.FormatFloat(*c.Queue.QPS, 'g', -1, 64)
+	}
+	setInt("retry-burst", c.Queue.Burst)
+
+	set("keychain-dir", c.Keychains.Dir)
+	setDuration("git-sync-period", c.Keychains.SyncPeriod)
+	set("org-keychain", c.Keychains.Org.URL)
+	set("org-keychain-auth", c.Keychains.Org.Auth)
+	set("org-keychain-known-hosts", strings.Join(c.Keychains.Org.KnownHosts, "\n"))
+	set("com-keychain", c.Keychains.Com.URL)
+	set("com-keychain-auth", c.Keychains.Com.Auth)
+	set("com-keychain-known-hosts", strings.Join(c.Keychains.Com.KnownHosts, "\n"))
+
+	set("git-branch", c.Git.Branch)
+	setInt("git-clone-depth", c.Git.CloneDepth)
+	set("ssh-known-hosts", c.Git.SSHKnownHosts)
+	set("github-api-url", c.Git.GitHubAPIURL)
+
+	setDuration("k8s-sync-period", c.Kubernetes.SyncPeriod)
+	set("namespaces", strings.Join(c.Kubernetes.Namespaces, ","))
+
+	setDuration("sweep-period", c.Sweep.Period)
+	setBool("sweep-dry-run", c.Sweep.DryRun)
+	setBool("require-policy", c.Policy.Required)
+
+	set("log-level", c.Log.Level)
+	set("log-format", c.Log.Format)
+
+	set("audit-log", c.Audit.Log)
+	set("audit-webhook-url", c.Audit.WebhookURL)
+	set("audit-hash-key-file", c.Audit.HashKeyFile)
+
+	if c.Notifications.Events != nil {
+		values["notify-events"] = strings.Join(c.Notifications.Events, ",")
+	}
+	setInt("notify-failure-threshold", c.Notifications.FailureThreshold)
+	setDuration("notify-dedup-window", c.Notifications.DedupWindow)
+	set("notify-webhook-url", c.Notifications.Webhook.URL)
+	set("notify-webhook-namespaces", strings.Join(c.Notifications.Webhook.Namespaces, ","))
+	set("notify-slack-url", c.Notifications.Slack.URL)
+	set("notify-slack-namespaces", strings.Join(c.Notifications.Slack.Namespaces, ","))
+	set("notify-smtp-addr", c.Notifications.SMTP.Addr)
+	set("notify-smtp-from", c.Notifications.SMTP.From)
+	set("notify-smtp-to", strings.Join(c.Notifications.SMTP.To, ","))
+	set("notify-smtp-username", c.Notifications.SMTP.Username)
+	set("notify-smtp-namespaces", strings.Join(c.Notifications.SMTP.Namespaces, ","))
+
+	set("metrics-addr", c.HTTP.MetricsAddr)
+	set("webhook-addr", c.HTTP.Webhook.Addr)
+	set("webhook-cert-file", c.HTTP.Webhook.CertFile)
+	set("webhook-key-file", c.HTTP.Webhook.KeyFile)
+
+	set("secrets-dir", c.SecretsDir)
+	set("cache-dir", c.CacheDir)
+	setInt("workers", c.Workers)
+	setDuration("shutdown-grace-period", c.ShutdownGracePeriod)
+
+	return values
+}
+
+// changedFlagValues is like flagValues, but also maps the settings that were
+// in last and have since been removed to their flags' defaults.
+func (c *Config) changedFlagValues(last *Config) map[string]string {
+	values := c.flagValues()
+	for name := range last.flagValues() {
+		if _, ok := values[name]; !ok {
+			values[name] = flag.Lookup(name).DefValue
+		}
+	}
+	return values
+}
+
+// explicitFlags returns the flags that were given on the command line.
+func explicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// applyConfig sets every flag that wasn't given on the command line to its
+// value from the configuration file. If only is not nil, only those flags are
+// set. It returns the names of the flags whose values changed.
+func applyConfig(values map[string]string, explicit, only map[string]bool) ([]string, error) {
+	var changed []string
+
+	for name, value := range values {
+		if explicit[name] || (only != nil && !only[name]) {
+			continue
+		}
+
+		f := flag.Lookup(name)
+		if f.Value.String() == value {
+			continue
+		}
+
+		if err := flag.Set(name, value); err != nil {
+			return changed, fmt.Errorf("%s: %v", name, err)
+		}
+		changed = append(changed, name)
+	}
+
+	return changed, nil
+}
+
+// watchConfig checks the configuration file for changes every period until ctx
+// is done, and calls reload with it whenever it changed and is still valid.
+// The file's contents are compared rather than its modification time, since
+// files mounted from a ConfigMap are replaced through symlinks.
+func watchConfig(ctx context.Context, file string, last []byte, period time.Duration, reload func(*Config)) {
+	for backoff.Sleep(ctx, period) {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.WithError(err).WithField("path", file).Error("could not read config")
+			continue
+		}
+
+		if bytes.Equal(b, last) {
+			continue
+		}
+		last = b
+
+		c, err := parseConfig(b)
+		if err != nil {
+			log.WithError(err).WithField("path", file).Error("not reloading invalid config")
+			continue
+		}
+
+		reload(c)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestReloadResetsRemovedSettings(t *testing.T) {
+	defer func(level string, period time.Duration) {
+		*logLevel, *sweepPeriod = level, period
+	}(*logLevel, *sweepPeriod)
+
+	last, err := parseConfig([]byte("version: 1\nlog: {level: debug}\nsweep: {period: 1m}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyConfig(last.flagValues(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := parseConfig([]byte("version: 1\nsweep: {period: 1m}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := applyConfig(c.changedFlagValues(last), nil, reloadableFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changed) != 1 || changed[0] != "log-level" {
+		t.Errorf("changed %v, want [log-level]", changed)
+	}
+	if *logLevel != flag.Lookup("log-level").DefValue {
+		t.Errorf("log-level is %q after removing it, want the default %q", *logLevel, flag.Lookup("log-level").DefValue)
+	}
+	if *sweepPeriod != time.Minute {
+		t.Errorf("sweep-period is %s, want the 1m0s still in the file", *sweepPeriod)
+	}
+}
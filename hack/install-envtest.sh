@@ -0,0 +1,51 @@
+#!/bin/bash
+
+# Builds the etcd, kube-apiserver and kube-controller-manager binaries the
+# TestEnv tests run into $KUBEBUILDER_ASSETS, /usr/local/kubebuilder/bin by
+# default, from the Go module proxy.
+
+set -o errexit
+set -o nounset
+set -o pipefail
+
+ETCD_VERSION=${ETCD_VERSION:-v3.5.16}
+KUBERNETES_VERSION=${KUBERNETES_VERSION:-v1.31.4}
+ASSETS=${KUBEBUILDER_ASSETS:-/usr/local/kubebuilder/bin}
+
+export GO111MODULE=on GOFLAGS=
+mkdir -p "${ASSETS}"
+BUILD=$(mktemp -d)
+trap 'rm -rf "${BUILD}"' EXIT
+
+# etcd's and Kubernetes' modules replace their own submodules with local
+# paths, so they are built from a module that requires them instead
+mkdir "${BUILD}/etcd"
+cd "${BUILD}/etcd"
+go mod init etcd >/dev/null
+go get "go.etcd.io/etcd/server/v3@${ETCD_VERSION}"
+go build -o "${ASSETS}/etcd" go.etcd.io/etcd/server/v3
+
+mkdir "${BUILD}/kubernetes"
+cd "${BUILD}/kubernetes"
+STAGING_VERSION=v0.${KUBERNETES_VERSION#v1.}
+{
+  echo "module kubernetes"
+  echo "require k8s.io/kubernetes ${KUBERNETES_VERSION}"
+  echo "replace ("
+  curl -sSfL "https://proxy.golang.org/k8s.io/kubernetes/@v/${KUBERNETES_VERSION}.mod" |
+    awk -v v="${STAGING_VERSION}" '$2 == "=>" && $3 ~ /^\.\/staging\// { print "\t" $1 " => " $1 " " v }'
+  echo ")"
+} > go.mod
+cat > tools.go <<'GO'
+//go:build tools
+
+package tools
+
+import (
+	_ "k8s.io/kubernetes/cmd/kube-apiserver"
+	_ "k8s.io/kubernetes/cmd/kube-controller-manager"
+)
+GO
+go mod tidy
+go build -o "${ASSETS}/kube-apiserver" k8s.io/kubernetes/cmd/kube-apiserver
+go build -o "${ASSETS}/kube-controller-manager" k8s.io/kubernetes/cmd/kube-controller-manager
@@ -0,0 +1,441 @@
+// Package envtest runs a local Kubernetes control plane for integration tests:
+// etcd, kube-apiserver, and kube-controller-manager running only the garbage
+// collector. The binaries are taken from $KUBEBUILDER_ASSETS, or
+// /usr/local/kubebuilder/bin, the same places controller-runtime's envtest
+// looks. The API server has to serve apiextensions.k8s.io/v1 and
+// admissionregistration.k8s.io/v1, which it does since Kubernetes 1.16.
+package envtest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/rest"
+)
+
+const defaultAssets = "/usr/local/kubebuilder/bin"
+
+var binaries = []string{"etcd", "kube-apiserver", "kube-controller-manager"}
+
+func assets() string {
+	if dir := os.Getenv("KUBEBUILDER_ASSETS"); dir != "" {
+		return dir
+	}
+	return defaultAssets
+}
+
+// Installed reports whether the control plane binaries can be found.
+func Installed() bool {
+	for _, name := range binaries {
+		if _, err := os.Stat(filepath.Join(assets(), name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Environment is a running control plane.
+type Environment struct {
+	// Config connects to the API server with a token of the system:masters
+	// group.
+	Config *rest.Config
+
+	dir    string
+	procs  []*process
+	client *http.Client
+}
+
+type process struct {
+	name string
+	cmd  *exec.Cmd
+	log  string
+	done chan struct{}
+}
+
+// Start starts a control plane, installing the CustomResourceDefinitions in
+// crdFiles before starting the garbage collector, so it knows about them.
+// These may be Helm templates: lines with template actions are dropped, and
+// apiextensions.k8s.io/v1beta1 definitions are converted to v1, keeping
+// unknown fields.
+func Start(crdFiles ...string) (*Environment, error) {
+	dir, err := ioutil.TempDir("", "envtest")
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Environment{dir: dir}
+	if err := e.start(crdFiles); err != nil {
+		e.Stop()
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Environment) start(crdFiles []string) error {
+	ports, err := freePorts(3)
+	if err != nil {
+		return err
+	}
+	etcdURL := fmt.Sprintf("http://127.0.0.1:%d", ports[0])
+
+	if err := e.run("etcd",
+		"--data-dir="+filepath.Join(e.dir, "etcd"),
+		"--listen-client-urls="+etcdURL,
+		"--advertise-client-urls="+etcdURL,
+		fmt.Sprintf("--listen-peer-urls=http://127.0.0.1:%d", ports[1]),
+		"--unsafe-no-fsync",
+	); err != nil {
+		return err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	tokens := filepath.Join(e.dir, "tokens.csv")
+	if err := ioutil.WriteFile(tokens, []byte(token+",admin,admin,system:masters\n"), 0600); err != nil {
+		return err
+	}
+	saKey := filepath.Join(e.dir, "sa.key")
+	if err := writeRSAKey(saKey); err != nil {
+		return err
+	}
+
+	host := fmt.Sprintf("https://127.0.0.1:%d", ports[2])
+	if err := e.run("kube-apiserver",
+		"--etcd-servers="+etcdURL,
+		"--cert-dir="+filepath.Join(e.dir, "certs"),
+		"--bind-address=127.0.0.1",
+		"--advertise-address=127.0.0.1",
+		fmt.Sprintf("--secure-port=%d", ports[2]),
+		"--token-auth-file="+tokens,
+		"--authorization-mode=AlwaysAllow",
+		"--service-cluster-ip-range=10.0.0.0/24",
+		"--service-account-issuer=https://127.0.0.1",
+		"--service-account-key-file="+saKey,
+		"--service-account-signing-key-file="+saKey,
+		"--disable-admission-plugins=ServiceAccount",
+	); err != nil {
+		return err
+	}
+
+	e.Config = &rest.Config{
+		Host:            host,
+		BearerToken:     token,
+		TLSClientConfig: rest.TLSClientConfig{Insecure: true},
+		QPS:             100,
+		Burst:           200,
+	}
+	e.client = &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+
+	if err := e.waitFor("kube-apiserver to be ready", func() bool {
+		var status string
+		return e.do("GET", "/readyz", nil, &status) == nil
+	}); err != nil {
+		return err
+	}
+
+	for _, file := range crdFiles {
+		if err := e.installCRDs(file); err != nil {
+			return fmt.Errorf("could not install CRDs from %s: %v", file, err)
+		}
+	}
+
+	kubeconfig := filepath.Join(e.dir, "kubeconfig")
+	if err := e.writeKubeconfig(kubeconfig); err != nil {
+		return err
+	}
+	return e.run("kube-controller-manager",
+		"--kubeconfig="+kubeconfig,
+		"--controllers=garbagecollector",
+		"--leader-elect=false",
+		"--secure-port=0",
+	)
+}
+
+// Stop stops the control plane and removes its data.
+func (e *Environment) Stop() error {
+	var failed []string
+	for i := len(e.procs) - 1; i >= 0; i-- {
+		p := e.procs[i]
+		p.cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-p.done:
+		case <-time.After(10 * time.Second):
+			p.cmd.Process.Kill()
+			<-p.done
+			failed = append(failed, p.name)
+		}
+	}
+
+	if err := os.RemoveAll(e.dir); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("had to kill %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Create posts obj as JSON to the collection at path, such as
+// "/apis/admissionregistration.k8s.io/v1/validatingwebhookconfigurations",
+// for APIs that have no vendored client.
+func (e *Environment) Create(path string, obj interface{}) error {
+	return e.do("POST", path, obj, nil)
+}
+
+// Delete deletes the object at path.
+func (e *Environment) Delete(path string) error {
+	return e.do("DELETE", path, nil, nil)
+}
+
+func (e *Environment) do(method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, e.Config.Host+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+e.Config.BearerToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, b)
+	}
+
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case *string:
+		*out = string(b)
+		return nil
+	default:
+		return json.Unmarshal(b, out)
+	}
+}
+
+// run starts a binary, logging to a file named after it.
+func (e *Environment) run(name string, args ...string) error {
+	log := filepath.Join(e.dir, name+".log")
+	f, err := os.Create(log)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cmd := exec.Command(filepath.Join(assets(), name), args...)
+	cmd.Stdout = f
+	cmd.Stderr = f
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	p := &process{name: name, cmd: cmd, log: log, done: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(p.done)
+	}()
+	e.procs = append(e.procs, p)
+	return nil
+}
+
+// waitFor waits until cond holds, failing early if a process exits.
+func (e *Environment) waitFor(what string, cond func() bool) error {
+	return wait.PollImmediate(100*time.Millisecond, time.Minute, func() (bool, error) {
+		for _, p := range e.procs {
+			select {
+			case <-p.done:
+				return false, fmt.Errorf("%s exited while waiting for %s:\n%s", p.name, what, tail(p.log))
+			default:
+			}
+		}
+		return cond(), nil
+	})
+}
+
+func (e *Environment) installCRDs(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range strings.Split(string(b), "\n---") {
+		var lines []string
+		for _, line := range strings.Split(doc, "\n") {
+			if !strings.Contains(line, "{{") {
+				lines = append(lines, line)
+			}
+		}
+
+		j, err := yaml.ToJSON([]byte(strings.Join(lines, "\n")))
+		if err != nil {
+			return err
+		}
+		var crd map[string]interface{}
+		if err := json.Unmarshal(j, &crd); err != nil {
+			return err
+		}
+		if crd == nil {
+			continue
+		}
+
+		toV1(crd)
+		if err := e.Create("/apis/apiextensions.k8s.io/v1/customresourcedefinitions", crd); err != nil {
+			return err
+		}
+
+		name := crd["metadata"].(map[string]interface{})["name"].(string)
+		if err := e.waitFor("CRD "+name+" to be established", func() bool {
+			return e.established(name)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toV1 converts a v1beta1 CustomResourceDefinition to v1, which moved
+// subresources and the schema into each version and requires a schema.
+func toV1(crd map[string]interface{}) {
+	crd["apiVersion"] = "apiextensions.k8s.io/v1"
+
+	spec := crd["spec"].(map[string]interface{})
+	subresources := spec["subresources"]
+	delete(spec, "subresources")
+	delete(spec, "validation")
+	delete(spec, "version")
+
+	for _, v := range spec["versions"].([]interface{}) {
+		version := v.(map[string]interface{})
+		if _, ok := version["schema"]; !ok {
+			version["schema"] = map[string]interface{}{
+				"openAPIV3Schema": map[string]interface{}{
+					"type":                                 "object",
+					"x-kubernetes-preserve-unknown-fields": true,
+				},
+			}
+		}
+		if subresources != nil {
+			version["subresources"] = subresources
+		}
+	}
+}
+
+func (e *Environment) established(name string) bool {
+	var crd struct {
+		Status struct {
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	}
+	if err := e.do("GET", "/apis/apiextensions.k8s.io/v1/customresourcedefinitions/"+name, nil, &crd); err != nil {
+		return false
+	}
+
+	for _, c := range crd.Status.Conditions {
+		if c.Type == "Established" && c.Status == "True" {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Environment) writeKubeconfig(path string) error {
+	config := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: envtest
+  cluster:
+    server: %s
+    insecure-skip-tls-verify: true
+users:
+- name: admin
+  user:
+    token: %s
+contexts:
+- name: envtest
+  context:
+    cluster: envtest
+    user: admin
+current-context: envtest
+`, e.Config.Host, e.Config.BearerToken)
+	return ioutil.WriteFile(path, []byte(config), 0600)
+}
+
+func freePorts(n int) ([]int, error) {
+	var ports []int
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		// kept open until all are picked, so they differ
+		defer l.Close()
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+	}
+	return ports, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func writeRSAKey(path string) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	return ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600)
+}
+
+// tail returns the end of a log file.
+func tail(path string) string {
+	b, _ := ioutil.ReadFile(path)
+	if len(b) > 4096 {
+		b = b[len(b)-4096:]
+	}
+	return string(b)
+}
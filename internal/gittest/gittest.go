@@ -0,0 +1,113 @@
+// Package gittest creates Git repositories for tests to clone from, using the
+// git command.
+package gittest
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Remote is a bare repository along with a clone of it that commits are made
+// in and pushed from.
+type Remote struct {
+	// URL is what to clone the bare repository from.
+	URL string
+
+	t      *testing.T
+	work   string
+	branch string
+}
+
+// NewRemote creates a bare repository in dir whose default branch is branch,
+// with an initial commit holding files.
+func NewRemote(t *testing.T, dir, branch string, files map[string]string) *Remote {
+	t.Helper()
+
+	r := &Remote{
+		URL:    filepath.Join(dir, "remote.git"),
+		t:      t,
+		work:   filepath.Join(dir, "work"),
+		branch: branch,
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r.git(dir, "init", "--quiet", "--bare", "--initial-branch="+branch, r.URL)
+	r.git(dir, "init", "--quiet", "--initial-branch="+branch, r.work)
+	r.git(r.work, "remote", "add", "origin", r.URL)
+	r.Commit(files)
+
+	return r
+}
+
+// Commit writes files to the repository, removing those whose contents are
+// empty, and pushes the result. Files starting with "#!" are made executable.
+// It returns the hash of the new commit.
+func (r *Remote) Commit(files map[string]string) string {
+	r.t.Helper()
+
+	for name, contents := range files {
+		p := filepath.Join(r.work, name)
+		if contents == "" {
+			if err := os.Remove(p); err != nil {
+				r.t.Fatal(err)
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			r.t.Fatal(err)
+		}
+		mode := os.FileMode(0644)
+		if strings.HasPrefix(contents, "#!") {
+			mode = 0755
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), mode); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+
+	r.git(r.work, "add", "--all")
+	r.git(r.work, "commit", "--quiet", "--allow-empty", "--message", "commit")
+	r.git(r.work, "push", "--quiet", "origin", r.branch)
+
+	return r.Head()
+}
+
+// Reset moves the branch back to commit and force-pushes it.
+func (r *Remote) Reset(commit string) {
+	r.t.Helper()
+
+	r.git(r.work, "reset", "--quiet", "--hard", commit)
+	r.git(r.work, "push", "--quiet", "--force", "origin", r.branch)
+}
+
+// Head returns the latest commit on the branch.
+func (r *Remote) Head() string {
+	r.t.Helper()
+	return strings.TrimSpace(r.git(r.work, "rev-parse", "HEAD"))
+}
+
+func (r *Remote) git(dir string, args ...string) string {
+	r.t.Helper()
+
+	cmd := exec.Command("git", append([]string{
+		"-c", "user.name=gittest",
+		"-c", "user.email=gittest@example.com",
+		"-c", "commit.gpgsign=false",
+	}, args...)...)
+	cmd.Dir = dir
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+
+	return string(out)
+}
@@ -1,39 +1,142 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	kubeinformers "k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
+	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"strings"
 	"syscall"
 	"time"
 
 	travisclientset "github.com/travis-ci/trvs-operator/pkg/client/clientset/versioned"
 	informers "github.com/travis-ci/trvs-operator/pkg/client/informers/externalversions"
+	travisinformers "github.com/travis-ci/trvs-operator/pkg/client/informers/externalversions/travisci/v1"
+	"github.com/travis-ci/trvs-operator/pkg/controller"
+	"github.com/travis-ci/trvs-operator/pkg/gitrepo"
+	"github.com/travis-ci/trvs-operator/pkg/keychain"
+	"github.com/travis-ci/trvs-operator/pkg/logging"
+	"github.com/travis-ci/trvs-operator/pkg/notify"
+	"github.com/travis-ci/trvs-operator/pkg/trvs"
 )
 
 var (
+	configFile         = flag.String("config", "", "A YAML configuration file; flags given on the command line take precedence over it")
+	configReloadPeriod = flag.Duration("config-reload-period", 10*time.Second, "How frequently to check the configuration file for changes")
+
 	trvsURL        = flag.String("trvs", "", "The URL for the trvs repo")
 	orgKeychainURL = flag.String("org-keychain", "", "The URL for the .org keychain")
 	comKeychainURL = flag.String("com-keychain", "", "The URL for the .com keychain")
 
 	gitSyncPeriod  = flag.Duration("git-sync-period", 1*time.Minute, "How frequently to sync the keychain Git repos")
 	kubeSyncPeriod = flag.Duration("k8s-sync-period", 5*time.Minute, "How frequently to resync all the relevant Kubernetes resources")
+	sweepPeriod    = flag.Duration("sweep-period", 10*time.Minute, "How frequently to look for orphaned secrets, or 0 to never look")
+	sweepDryRun    = flag.Bool("sweep-dry-run", false, "Report orphaned secrets with events instead of deleting them")
+	gracePeriod    = flag.Duration("shutdown-grace-period", 25*time.Second, "How long to wait for in-flight work to finish when shutting down")
+
+	trvsAuth        = flag.String("trvs-auth", gitrepo.AuthSSH, "How to authenticate with the trvs repo: ssh, token or github-app")
+	orgKeychainAuth = flag.String("org-keychain-auth", gitrepo.AuthSSH, "How to authenticate with the .org keychain: ssh, token or github-app")
+	comKeychainAuth = flag.String("com-keychain-auth", gitrepo.AuthSSH, "How to authenticate with the .com keychain: ssh, token or github-app")
+	knownHostsFile  = flag.String("ssh-known-hosts", "", "A known_hosts file to check SSH host keys against, for repos without their own")
+	githubAPIURL    = flag.String("github-api-url", "https://api.github.com", "The GitHub API to request GitHub App installation tokens from")
+
+	trvsKnownHosts        = flag.String("trvs-known-hosts", "", "known_hosts lines, one per line, to check the SSH host keys of the trvs repo against")
+	orgKeychainKnownHosts = flag.String("org-keychain-known-hosts", "", "known_hosts lines, one per line, to check the SSH host keys of the .org keychain against")
+	comKeychainKnownHosts = flag.String("com-keychain-known-hosts", "", "known_hosts lines, one per line, to check the SSH host keys of the .com keychain against")
+
+	gitBranch     = flag.String("git-branch", "", "The branch of the trvs and keychain repos to use, instead of the default branch of each")
+	gitCloneDepth = flag.Int("git-clone-depth", 0, "Limit clones and fetches to this many commits, or 0 for the full history")
+
+	requirePolicy = flag.Bool("require-policy", false, "Deny TrvsSecrets in namespaces that no TrvsSecretPolicy applies to")
+	webhookAddr   = flag.String("webhook-addr", "", "The address to serve the admission webhook on, if set")
+	webhookCert   = flag.String("webhook-cert-file", "/etc/webhook/tls.crt", "The TLS certificate for the admission webhook")
+	webhookKey    = flag.String("webhook-key-file", "/etc/webhook/tls.key", "The TLS key for the admission webhook")
+
+	watchNamespace = flag.String("watch-namespace", "", "Only watch TrvsSecrets and secrets in this namespace")
+	namespaces     = flag.String("namespaces", "", "Only watch TrvsSecrets and secrets in these comma-separated namespaces")
+
+	auditLog        = flag.String("audit-log", "", "A file to append audit records of secret changes to as JSON lines, or - for stdout")
+	auditWebhookURL = flag.String("audit-webhook-url", "", "A URL to post audit records of secret changes to as JSON")
+	auditHashKey    = flag.String("audit-hash-key-file", "", "A file holding the key values in audit records are hashed with. Without one, a random key is used and hashes can only be compared within one run")
+
+	notifyWebhookURL        = flag.String("notify-webhook-url", "", "A URL to post notifications to as JSON")
+	notifyWebhookNamespaces = flag.String("notify-webhook-namespaces", "", "Only post notifications about these comma-separated namespaces to -notify-webhook-url; globs are allowed")
+	notifySlackURL          = flag.String("notify-slack-url", "", "A Slack incoming webhook URL to post notifications to")
+	notifySlackNamespaces   = flag.String("notify-slack-namespaces", "", "Only post notifications about these comma-separated namespaces to Slack; globs are allowed")
+	notifySMTPAddr          = flag.String("notify-smtp-addr", "", "The host:port of a mail server to email notifications through")
+	notifySMTPFrom          = flag.String("notify-smtp-from", "", "The sender of notification emails")
+	notifySMTPTo            = flag.String("notify-smtp-to", "", "The comma-separated recipients of notification emails")
+	notifySMTPUsername      = flag.String("notify-smtp-username", "", "The username for the mail server; the password is read from smtp.password in -secrets-dir")
+	notifySMTPNamespaces    = flag.String("notify-smtp-namespaces", "", "Only email notifications about these comma-separated namespaces; globs are allowed")
+	notifyEvents            = flag.String("notify-events", strings.Join(notify.Events, ","), "The comma-separated events to notify about: failing, recovered and changed")
+	notifyFailureThreshold  = flag.Int("notify-failure-threshold", 3, "How many syncs of a TrvsSecret must fail in a row before notifying that it is failing")
+	notifyDedupWindow       = flag.Duration("notify-dedup-window", time.Hour, "How long to drop notifications identical to one already sent")
+
+	logLevel  = flag.String("log-level", "info", "The log level, optionally followed by levels for subsystems, such as info,keychain=debug")
+	logFormat = flag.String("log-format", "text", "The log format: text or json")
+
+	trvsDir     = flag.String("trvs-dir", "/trvs", "The directory to clone and check out the trvs repo in")
+	keychainDir = flag.String("keychain-dir", os.Getenv("TRAVIS_KEYCHAIN_DIR"), "The directory to clone the keychain repos in")
+	secretsDir  = flag.String("secrets-dir", "/etc/secrets", "The directory holding the credentials for the repos")
+	workers     = flag.Int("workers", 2, "How many TrvsSecrets to process at the same time")
+
+	trvsConcurrency = flag.Int("trvs-concurrency", 4, "How many trvs commands may run at the same time")
+	retryBaseDelay  = flag.Duration("retry-base-delay", 5*time.Millisecond, "How long to wait before retrying a failed TrvsSecret the first time; the delay doubles with each failure")
+	retryMaxDelay   = flag.Duration("retry-max-delay", 1000*time.Second, "The longest to wait before retrying a failed TrvsSecret")
+	retryQPS        = flag.Float64("retry-qps", 10, "How many retries per second are allowed across all TrvsSecrets")
+	retryBurst      = flag.Int("retry-burst", 100, "How many retries may happen at once before -retry-qps applies")
+
+	cacheDir    = flag.String("cache-dir", "", "A directory to persist generated trvs output in, in addition to memory. It holds secrets in plaintext")
+	metricsAddr = flag.String("metrics-addr", "", "The address to serve expvar metrics on at /debug/vars, if set")
 )
 
-var trvs *Trvs
-
 func main() {
 	flag.Parse()
 
-	stopCh := setupSignalHandler()
-	log.SetLevel(log.DebugLevel)
+	explicit := explicitFlags()
+	var config *Config
+	var rawConfig []byte
+	if *configFile != "" {
+		var err error
+		config, rawConfig, err = LoadConfig(*configFile)
+		if err != nil {
+			log.WithError(err).Fatal("could not load config")
+		}
+
+		if _, err := applyConfig(config.flagValues(), explicit, nil); err != nil {
+			log.WithError(err).Fatal("invalid config")
+		}
+	}
 
-	keychains := setupKeychains()
+	if err := logging.Configure(*logLevel, *logFormat); err != nil {
+		log.WithError(err).Fatal("invalid logging flags")
+	}
+
+	ctx := setupSignalHandler()
+
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+
+	keychains, err := setupKeychains()
+	if err != nil {
+		log.WithError(err).Fatal("could not set up keychains")
+	}
+
+	generator, err := setupTrvs(keychains)
+	if err != nil {
+		log.WithError(err).Fatal("could not set up trvs")
+	}
 
 	cfg, err := clientcmd.BuildConfigFromFlags("", "")
 	if err != nil {
@@ -53,78 +156,392 @@ func main() {
 	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(kubeclient, *kubeSyncPeriod)
 	travisInformerFactory := informers.NewSharedInformerFactory(travisclient, *kubeSyncPeriod)
 
-	controller := NewController(keychains, *gitSyncPeriod, kubeclient, travisclient,
-		kubeInformerFactory.Core().V1().Secrets(),
-		travisInformerFactory.Travisci().V1().TrvsSecrets())
+	sweep := controller.SweepOptions{
+		Period: *sweepPeriod,
+		DryRun: *sweepDryRun,
+	}
+
+	policies := controller.NewPolicyAuthorizer(
+		travisInformerFactory.Travisci().V1().TrvsSecretPolicies(),
+		kubeInformerFactory.Core().V1().Namespaces(),
+		*requirePolicy)
+
+	var secretInformers []coreinformers.SecretInformer
+	var trvsSecretInformers []travisinformers.TrvsSecretInformer
+	starters := []func(<-chan struct{}){kubeInformerFactory.Start, travisInformerFactory.Start}
+
+	if nss := watchedNamespaces(); len(nss) > 0 {
+		log.WithField("namespaces", nss).Info("only watching some namespaces")
+
+		for _, ns := range nss {
+			kf := kubeinformers.NewSharedInformerFactoryWithOptions(kubeclient, *kubeSyncPeriod, kubeinformers.WithNamespace(ns))
+			tf := informers.NewSharedInformerFactoryWithOptions(travisclient, *kubeSyncPeriod, informers.WithNamespace(ns))
+
+			secretInformers = append(secretInformers, kf.Core().V1().Secrets())
+			trvsSecretInformers = append(trvsSecretInformers, tf.Travisci().V1().TrvsSecrets())
+			starters = append(starters, kf.Start, tf.Start)
+		}
+	} else {
+		secretInformers = append(secretInformers, kubeInformerFactory.Core().V1().Secrets())
+		trvsSecretInformers = append(trvsSecretInformers, travisInformerFactory.Travisci().V1().TrvsSecrets())
+	}
+
+	queue := controller.QueueOptions{
+		RetryBaseDelay: *retryBaseDelay,
+		RetryMaxDelay:  *retryMaxDelay,
+		QPS:            *retryQPS,
+		Burst:          *retryBurst,
+	}
+
+	notifier, err := setupNotifier()
+	if err != nil {
+		log.WithError(err).Fatal("could not set up notifications")
+	}
+
+	auditSinks, err := setupAuditSinks()
+	if err != nil {
+		log.WithError(err).Fatal("could not set up audit log")
+	}
+
+	var hashKey []byte
+	if *auditHashKey != "" {
+		if hashKey, err = ioutil.ReadFile(*auditHashKey); err != nil {
+			log.WithError(err).Fatal("could not read audit hash key")
+		}
+	}
+
+	// changes to secrets reach the notifier through the audit stream
+	audit := &controller.Auditor{
+		Sinks:   append(auditSinks, notifier),
+		Fetch:   controller.FetchTrvsSecret(travisclient),
+		HashKey: bytes.TrimSpace(hashKey),
+	}
+
+	c := controller.New(generator, keychains, kubeclient, travisclient, secretInformers, trvsSecretInformers,
+		controller.WithSyncPeriod(*gitSyncPeriod),
+		controller.WithSweep(sweep),
+		controller.WithAuthorizer(policies),
+		controller.WithAuditor(audit),
+		controller.WithNotifier(notifier),
+		controller.WithQueue(queue))
 
-	kubeInformerFactory.Start(stopCh)
-	travisInformerFactory.Start(stopCh)
+	for _, start := range starters {
+		start(ctx.Done())
+	}
+
+	if *webhookAddr != "" {
+		go controller.ServeWebhook(controller.WebhookOptions{
+			Addr:     *webhookAddr,
+			CertFile: *webhookCert,
+			KeyFile:  *webhookKey,
+		}, policies)
+	}
 
-	if err := controller.Run(2, stopCh); err != nil {
+	if config != nil {
+		r := &reloader{
+			last:       config,
+			explicit:   explicit,
+			policies:   policies,
+			controller: c,
+			audit:      audit,
+			notifier:   notifier,
+		}
+		go watchConfig(ctx, *configFile, rawConfig, *configReloadPeriod, r.reload)
+	}
+
+	err = c.Run(ctx, *workers, *gracePeriod)
+
+	// write out the records and send the notifications of the last syncs
+	closeAuditSinks(audit.SetSinks(nil))
+	notifier.Close()
+
+	if err != nil {
 		log.WithError(err).Fatal("error running controller")
 	}
 }
 
-func setupSignalHandler() <-chan struct{} {
-	stop := make(chan struct{})
+// setupSignalHandler returns a context that is cancelled on the first SIGTERM
+// or interrupt. A second signal exits immediately.
+func setupSignalHandler() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
 		<-c
-		close(stop)
+		log.Info("shutting down")
+		cancel()
 		<-c
 		os.Exit(1)
 	}()
 
-	return stop
+	return ctx
 }
 
-func setupKeychains() Keychains {
-	var ks Keychains
+func setupAuditSinks() ([]controller.AuditSink, error) {
+	var sinks []controller.AuditSink
 
-	ks.Org = createKeychain("travis-keychain", *orgKeychainURL)
-	ks.Com = createKeychain("travis-pro-keychain", *comKeychainURL)
+	if *auditLog != "" {
+		sink, err := controller.NewFileSink(*auditLog)
+		if err != nil {
+			return nil, fmt.Errorf("could not open audit log %s: %v", *auditLog, err)
+		}
+		sinks = append(sinks, sink)
+	}
 
-	trvs = createTrvs(*trvsURL, ks)
+	if *auditWebhookURL != "" {
+		sinks = append(sinks, controller.NewHTTPSink(*auditWebhookURL))
+	}
 
-	return ks
+	return sinks, nil
 }
 
-const trvsKeyFile = "/etc/secrets/trvs.key"
+// setupNotifier returns a notifier sending to every configured sink. It sends
+// nothing if there are none.
+func setupNotifier() (*notify.Notifier, error) {
+	var routes []notify.Route
 
-func createTrvs(url string, ks Keychains) *Trvs {
-	key, err := ioutil.ReadFile(trvsKeyFile)
-	if err != nil {
-		log.WithError(err).WithField("file", trvsKeyFile).Fatal("could not read trvs key file")
+	if *notifyWebhookURL != "" {
+		routes = append(routes, notify.Route{
+			Namespaces: splitList(*notifyWebhookNamespaces),
+			Sink:       notify.NewWebhookSink(*notifyWebhookURL),
+		})
+	}
+
+	if *notifySlackURL != "" {
+		routes = append(routes, notify.Route{
+			Namespaces: splitList(*notifySlackNamespaces),
+			Sink:       notify.NewSlackSink(*notifySlackURL),
+		})
+	}
+
+	if *notifySMTPAddr != "" {
+		sink := &notify.SMTPSink{
+			Addr:     *notifySMTPAddr,
+			From:     *notifySMTPFrom,
+			To:       splitList(*notifySMTPTo),
+			Username: *notifySMTPUsername,
+		}
+		if sink.From == "" || len(sink.To) == 0 {
+			return nil, fmt.Errorf("-notify-smtp-from and -notify-smtp-to are required with -notify-smtp-addr")
+		}
+
+		if sink.Username != "" {
+			password, err := ioutil.ReadFile(path.Join(*secretsDir, "smtp.password"))
+			if err != nil {
+				return nil, fmt.Errorf("could not read SMTP password: %v", err)
+			}
+			sink.Password = strings.TrimSpace(string(password))
+		}
+
+		routes = append(routes, notify.Route{
+			Namespaces: splitList(*notifySMTPNamespaces),
+			Sink:       sink,
+		})
 	}
 
-	t, err := NewTrvs(url, key, ks)
+	events := splitList(*notifyEvents)
+	for _, e := range events {
+		if !notify.IsEvent(e) {
+			return nil, fmt.Errorf("unknown notification event %q", e)
+		}
+	}
+
+	return &notify.Notifier{
+		Routes:           routes,
+		Events:           events,
+		FailureThreshold: *notifyFailureThreshold,
+		DedupWindow:      *notifyDedupWindow,
+	}, nil
+}
+
+// reloader applies the settings from a changed configuration file that can be
+// changed at runtime, and warns about the ones that can't.
+type reloader struct {
+	last     *Config
+	explicit map[string]bool
+
+	policies   *controller.PolicyAuthorizer
+	controller *controller.Controller
+	audit      *controller.Auditor
+	notifier   *notify.Notifier
+}
+
+func (r *reloader) reload(c *Config) {
+	values := c.changedFlagValues(r.last)
+	r.last = c
+
+	for name, value := range values {
+		if !r.explicit[name] && !reloadableFlags[name] && flag.Lookup(name).Value.String() != value {
+			log.WithField("flag", name).Warn("config changed a setting that needs a restart")
+		}
+	}
+
+	changed, err := applyConfig(values, r.explicit, reloadableFlags)
 	if err != nil {
-		log.WithError(err).Fatal("could not create trvs")
+		log.WithError(err).Error("could not apply config")
 	}
 
-	return t
+	var logs, sweep, audit, notifications bool
+	for _, name := range changed {
+		switch {
+		case name == "log-level", name == "log-format":
+			logs = true
+		case name == "require-policy":
+			r.policies.SetRequirePolicy(*requirePolicy)
+		case strings.HasPrefix(name, "sweep-"):
+			sweep = true
+		case strings.HasPrefix(name, "audit-"):
+			audit = true
+		case strings.HasPrefix(name, "notify-"):
+			notifications = true
+		}
+	}
+
+	if logs {
+		if err := logging.Configure(*logLevel, *logFormat); err != nil {
+			log.WithError(err).Error("could not reconfigure logging")
+		}
+	}
+
+	if sweep {
+		r.controller.SetSweep(controller.SweepOptions{
+			Period: *sweepPeriod,
+			DryRun: *sweepDryRun,
+		})
+	}
+
+	if notifications {
+		if n, err := setupNotifier(); err != nil {
+			log.WithError(err).Error("could not reconfigure notifications, keeping the old settings")
+		} else {
+			r.notifier.Reconfigure(n)
+		}
+	}
+
+	if audit {
+		if sinks, err := setupAuditSinks(); err != nil {
+			log.WithError(err).Error("could not reconfigure audit log, keeping the old settings")
+		} else {
+			go closeAuditSinks(r.audit.SetSinks(append(sinks, r.notifier)))
+		}
+	}
+
+	log.WithField("changed", changed).Info("reloaded config")
+}
+
+// closeAuditSinks closes sinks that were replaced or aren't needed anymore,
+// once everything written to them is out.
+func closeAuditSinks(sinks []controller.AuditSink) {
+	for _, sink := range sinks {
+		switch sink := sink.(type) {
+		case *controller.WriterSink:
+			sink.Close()
+		case *controller.HTTPSink:
+			sink.Close()
+		}
+	}
 }
 
-func createKeychain(name, url string) *Keychain {
-	entry := log.WithField("name", name)
+// watchedNamespaces returns the namespaces to watch, or nothing to watch all of
+// them.
+func watchedNamespaces() []string {
+	return splitList(*namespaces + "," + *watchNamespace)
+}
 
-	if url == "" {
-		entry.Fatal("no url set for keychain")
+// splitList splits a comma-separated flag value, dropping empty and repeated
+// items.
+func splitList(s string) []string {
+	var items []string
+	seen := make(map[string]bool)
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" && !seen[item] {
+			seen[item] = true
+			items = append(items, item)
+		}
 	}
 
-	keyFile := "/etc/secrets/" + name + ".key"
+	return items
+}
+
+func serveMetrics(addr string) {
+	// expvar registers its handler on the default mux
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.WithError(err).WithField("addr", addr).Error("could not serve metrics")
+	}
+}
+
+func setupKeychains() (keychain.Keychains, error) {
+	var ks keychain.Keychains
+	var err error
+
+	if ks.Org, err = createKeychain("travis-keychain", *orgKeychainURL, *orgKeychainAuth, *orgKeychainKnownHosts); err != nil {
+		return ks, err
+	}
+
+	if ks.Com, err = createKeychain("travis-pro-keychain", *comKeychainURL, *comKeychainAuth, *comKeychainKnownHosts); err != nil {
+		return ks, err
+	}
+
+	return ks, nil
+}
+
+func authOptions(method, knownHosts string) gitrepo.AuthOptions {
+	var lines []string
+	for _, line := range strings.Split(knownHosts, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return gitrepo.AuthOptions{
+		Method:         method,
+		SecretsDir:     *secretsDir,
+		KnownHosts:     lines,
+		KnownHostsFile: *knownHostsFile,
+		GitHubAPIURL:   *githubAPIURL,
+	}
+}
+
+func gitOptions() gitrepo.Options {
+	return gitrepo.Options{
+		Branch: *gitBranch,
+		Depth:  *gitCloneDepth,
+	}
+}
+
+func setupTrvs(ks keychain.Keychains) (*trvs.Trvs, error) {
+	auth, err := gitrepo.NewAuth("trvs", authOptions(*trvsAuth, *trvsKnownHosts))
+	if err != nil {
+		return nil, fmt.Errorf("could not read trvs credentials: %v", err)
+	}
+
+	cache, err := trvs.NewCache(*cacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not create trvs cache in %s: %v", *cacheDir, err)
+	}
+
+	repo := gitrepo.New(path.Join(*trvsDir, "repo"), *trvsURL, auth, gitOptions())
+	return trvs.New(*trvsDir, repo, ks, cache, *trvsConcurrency)
+}
+
+func createKeychain(name, url, method, knownHosts string) (*keychain.Keychain, error) {
+	if url == "" {
+		return nil, fmt.Errorf("no url set for keychain %s", name)
+	}
 
-	key, err := ioutil.ReadFile(keyFile)
+	auth, err := gitrepo.NewAuth(name, authOptions(method, knownHosts))
 	if err != nil {
-		entry.WithError(err).WithField("file", keyFile).Fatal("could not read key file")
+		return nil, fmt.Errorf("could not read credentials for keychain %s: %v", name, err)
 	}
 
-	k, err := NewKeychain(name, url, key)
+	repo := gitrepo.New(path.Join(*keychainDir, name), url, auth, gitOptions())
+	k, err := keychain.New(name, *keychainDir, repo)
 	if err != nil {
-		entry.WithError(err).Fatal("could not create keychain")
+		return nil, fmt.Errorf("could not create keychain %s: %v", name, err)
 	}
 
-	return k
+	return k, nil
 }
@@ -0,0 +1,44 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +genclient:nonNamespaced
+// +genclient:noStatus
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// TrvsSecretPolicy limits what TrvsSecrets in some namespaces may request.
+type TrvsSecretPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              TrvsSecretPolicySpec `json:"spec"`
+}
+
+// TrvsSecretPolicySpec lists the namespaces a policy applies to and what they
+// are allowed to request. An empty list allows anything, except for Files:
+// files are only allowed if they are listed. Apps, environments and files may
+// be glob patterns.
+type TrvsSecretPolicySpec struct {
+	// Namespaces the policy applies to by name.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// NamespaceSelector selects namespaces the policy applies to by label.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// Keychains that may be used, "org" and/or "com".
+	Keychains []string `json:"keychains,omitempty"`
+
+	Apps         []string `json:"apps,omitempty"`
+	Environments []string `json:"environments,omitempty"`
+	Files        []string `json:"files,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+type TrvsSecretPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TrvsSecretPolicy `json:"items"`
+}
@@ -33,6 +33,8 @@ func addKnownTypes(scheme *runtime.Scheme) error {
 		SchemeGroupVersion,
 		&TrvsSecret{},
 		&TrvsSecretList{},
+		&TrvsSecretPolicy{},
+		&TrvsSecretPolicyList{},
 	)
 
 	// register the type in the scheme
@@ -1,17 +1,18 @@
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // +genclient
-// +genclient:noStatus
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 type TrvsSecret struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
-	Spec              TrvsSecretSpec `json:"spec"`
+	Spec              TrvsSecretSpec   `json:"spec"`
+	Status            TrvsSecretStatus `json:"status,omitempty"`
 }
 
 type TrvsSecretSpec struct {
@@ -22,8 +23,135 @@ type TrvsSecretSpec struct {
 	File        string `json:"file"`
 	Key         string `json:"key"`
 	RawKeys     bool   `json:"rawKeys"`
+
+	// AdoptionPolicy decides what happens when a secret with the same name
+	// already exists but isn't managed by this TrvsSecret.
+	AdoptionPolicy AdoptionPolicy `json:"adoptionPolicy,omitempty"`
+
+	// DeletionPolicy decides what happens to the secret when the TrvsSecret is
+	// deleted.
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// DriftPolicy decides what happens when the secret is edited by hand.
+	DriftPolicy DriftPolicy `json:"driftPolicy,omitempty"`
+
+	// Suspend stops the operator from reconciling the secret until it is set
+	// back to false. Deleting the TrvsSecret still works while suspended.
+	Suspend bool `json:"suspend,omitempty"`
+
+	// HistoryLimit is how many previously generated versions of the secret
+	// are kept around to roll back to. Zero keeps none.
+	HistoryLimit int32 `json:"historyLimit,omitempty"`
+
+	// RollbackTo restores the secret to the given revision from its history
+	// and pins it there until the field is cleared.
+	RollbackTo string `json:"rollbackTo,omitempty"`
+
+	// Immutable writes each version of the generated data to a new secret
+	// named after its revision instead of updating a single secret.
+	Immutable bool `json:"immutable,omitempty"`
+
+	// Retention is how long a superseded immutable secret is kept before it is
+	// deleted. Defaults to 24 hours.
+	Retention metav1.Duration `json:"retention,omitempty"`
+}
+
+type TrvsSecretStatus struct {
+	// ObservedGeneration is the generation of the spec that was last acted on.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Suspended is true while reconciling is suspended.
+	Suspended bool `json:"suspended,omitempty"`
+
+	// KeychainCommit is the keychain commit the secret was last generated from.
+	KeychainCommit string `json:"keychainCommit,omitempty"`
+
+	// LastUpdateTime is when the secret was last created or changed.
+	LastUpdateTime *metav1.Time `json:"lastUpdateTime,omitempty"`
+
+	// LastResyncAt is the value of the resync-at annotation that was last
+	// handled.
+	LastResyncAt string `json:"lastResyncAt,omitempty"`
+
+	// Revision identifies the version of the data the secret currently holds.
+	Revision string `json:"revision,omitempty"`
+
+	// PinnedRevision is set while the secret is rolled back to a revision.
+	PinnedRevision string `json:"pinnedRevision,omitempty"`
+
+	// CurrentSecret is the name of the secret holding the current data.
+	CurrentSecret string `json:"currentSecret,omitempty"`
+
+	// DriftedDataHash is the hash of the data of the secret when it was last
+	// found edited outside of the operator. Each edit is only reported once.
+	DriftedDataHash string `json:"driftedDataHash,omitempty"`
+
+	// Conditions describe problems that keep the secret from being generated.
+	Conditions []TrvsSecretCondition `json:"conditions,omitempty"`
 }
 
+type TrvsSecretConditionType string
+
+const (
+	// TrvsSecretForbidden is true when no TrvsSecretPolicy allows the secret.
+	TrvsSecretForbidden TrvsSecretConditionType = "Forbidden"
+
+	// TrvsSecretDrifted is true while the secret holds edits made outside of
+	// the operator.
+	TrvsSecretDrifted TrvsSecretConditionType = "Drifted"
+)
+
+type TrvsSecretCondition struct {
+	Type               TrvsSecretConditionType `json:"type"`
+	Status             corev1.ConditionStatus  `json:"status"`
+	LastTransitionTime metav1.Time             `json:"lastTransitionTime,omitempty"`
+	Reason             string                  `json:"reason,omitempty"`
+	Message            string                  `json:"message,omitempty"`
+}
+
+type AdoptionPolicy string
+
+const (
+	// AdoptionPolicyFail leaves the existing secret alone and reports an error.
+	// This is the default.
+	AdoptionPolicyFail AdoptionPolicy = "fail"
+
+	// AdoptionPolicyAdopt takes over the existing secret, replacing its data.
+	AdoptionPolicyAdopt AdoptionPolicy = "adopt"
+
+	// AdoptionPolicyMerge takes over the existing secret, keeping any keys that
+	// aren't generated alongside the generated ones.
+	AdoptionPolicyMerge AdoptionPolicy = "merge"
+)
+
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete deletes the secret along with the TrvsSecret. This is
+	// the default.
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+
+	// DeletionPolicyRetain keeps the secret, labelled with the name of the
+	// TrvsSecret it belonged to, so it can be adopted again later.
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+
+	// DeletionPolicyOrphan keeps the secret and removes everything the operator
+	// added to it, leaving an ordinary unmanaged secret.
+	DeletionPolicyOrphan DeletionPolicy = "Orphan"
+)
+
+type DriftPolicy string
+
+const (
+	// DriftPolicyHeal overwrites edits with the generated data. This is the
+	// default.
+	DriftPolicyHeal DriftPolicy = "Heal"
+
+	// DriftPolicyPause leaves an edited secret alone until the edits are
+	// reverted or the policy is changed.
+	DriftPolicyPause DriftPolicy = "Pause"
+)
+
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 type TrvsSecretList struct {
@@ -0,0 +1,50 @@
+// Package backoff provides delays for retrying operations that keep failing.
+package backoff
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes exponentially increasing delays with jitter, for retrying
+// operations that keep failing.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	attempt uint
+}
+
+// Next returns the delay before the next attempt. Each call doubles the delay,
+// up to Max, and picks a random value between half of it and all of it so
+// that retries don't line up.
+func (b *Backoff) Next() time.Duration {
+	d := b.Min << b.attempt
+	if d > b.Max || d < b.Min {
+		d = b.Max
+	} else {
+		b.attempt++
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Reset starts over from the minimum delay after a success.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// Sleep waits for d to pass, returning early with false if ctx is done first.
+func Sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
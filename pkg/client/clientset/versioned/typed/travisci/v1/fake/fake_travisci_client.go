@@ -32,6 +32,10 @@ func (c *FakeTravisciV1) TrvsSecrets(namespace string) v1.TrvsSecretInterface {
 	return &FakeTrvsSecrets{c, namespace}
 }
 
+func (c *FakeTravisciV1) TrvsSecretPolicies() v1.TrvsSecretPolicyInterface {
+	return &FakeTrvsSecretPolicies{c}
+}
+
 // RESTClient returns a RESTClient that is used to communicate
 // with API server by this client implementation.
 func (c *FakeTravisciV1) RESTClient() rest.Interface {
@@ -100,6 +100,18 @@ func (c *FakeTrvsSecrets) Update(trvsSecret *travisciv1.TrvsSecret) (result *tra
 	return obj.(*travisciv1.TrvsSecret), err
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *FakeTrvsSecrets) UpdateStatus(trvsSecret *travisciv1.TrvsSecret) (*travisciv1.TrvsSecret, error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewUpdateSubresourceAction(trvssecretsResource, "status", c.ns, trvsSecret), &travisciv1.TrvsSecret{})
+
+	if obj == nil {
+		return nil, err
+	}
+	return obj.(*travisciv1.TrvsSecret), err
+}
+
 // Delete takes name of the trvsSecret and deletes it. Returns an error if one occurs.
 func (c *FakeTrvsSecrets) Delete(name string, options *v1.DeleteOptions) error {
 	_, err := c.Fake.
@@ -119,7 +131,7 @@ func (c *FakeTrvsSecrets) DeleteCollection(options *v1.DeleteOptions, listOption
 // Patch applies the patch and returns the patched trvsSecret.
 func (c *FakeTrvsSecrets) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (result *travisciv1.TrvsSecret, err error) {
 	obj, err := c.Fake.
-		Invokes(testing.NewPatchSubresourceAction(trvssecretsResource, c.ns, name, pt, data, subresources...), &travisciv1.TrvsSecret{})
+		Invokes(testing.NewPatchSubresourceAction(trvssecretsResource, c.ns, name, data, subresources...), &travisciv1.TrvsSecret{})
 
 	if obj == nil {
 		return nil, err
@@ -28,6 +28,7 @@ import (
 type TravisciV1Interface interface {
 	RESTClient() rest.Interface
 	TrvsSecretsGetter
+	TrvsSecretPoliciesGetter
 }
 
 // TravisciV1Client is used to interact with features provided by the travisci.com group.
@@ -39,6 +40,10 @@ func (c *TravisciV1Client) TrvsSecrets(namespace string) TrvsSecretInterface {
 	return newTrvsSecrets(c, namespace)
 }
 
+func (c *TravisciV1Client) TrvsSecretPolicies() TrvsSecretPolicyInterface {
+	return newTrvsSecretPolicies(c)
+}
+
 // NewForConfig creates a new TravisciV1Client for the given config.
 func NewForConfig(c *rest.Config) (*TravisciV1Client, error) {
 	config := *c
@@ -37,6 +37,7 @@ type TrvsSecretsGetter interface {
 type TrvsSecretInterface interface {
 	Create(*v1.TrvsSecret) (*v1.TrvsSecret, error)
 	Update(*v1.TrvsSecret) (*v1.TrvsSecret, error)
+	UpdateStatus(*v1.TrvsSecret) (*v1.TrvsSecret, error)
 	Delete(name string, options *metav1.DeleteOptions) error
 	DeleteCollection(options *metav1.DeleteOptions, listOptions metav1.ListOptions) error
 	Get(name string, options metav1.GetOptions) (*v1.TrvsSecret, error)
@@ -120,6 +121,22 @@ func (c *trvsSecrets) Update(trvsSecret *v1.TrvsSecret) (result *v1.TrvsSecret,
 	return
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+
+func (c *trvsSecrets) UpdateStatus(trvsSecret *v1.TrvsSecret) (result *v1.TrvsSecret, err error) {
+	result = &v1.TrvsSecret{}
+	err = c.client.Put().
+		Namespace(c.ns).
+		Resource("trvssecrets").
+		Name(trvsSecret.Name).
+		SubResource("status").
+		Body(trvsSecret).
+		Do().
+		Into(result)
+	return
+}
+
 // Delete takes name of the trvsSecret and deletes it. Returns an error if one occurs.
 func (c *trvsSecrets) Delete(name string, options *metav1.DeleteOptions) error {
 	return c.client.Delete().
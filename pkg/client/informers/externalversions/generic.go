@@ -55,6 +55,8 @@ func (f *sharedInformerFactory) ForResource(resource schema.GroupVersionResource
 	// Group=travisci.com, Version=v1
 	case v1.SchemeGroupVersion.WithResource("trvssecrets"):
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Travisci().V1().TrvsSecrets().Informer()}, nil
+	case v1.SchemeGroupVersion.WithResource("trvssecretpolicies"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Travisci().V1().TrvsSecretPolicies().Informer()}, nil
 
 	}
 
@@ -26,6 +26,8 @@ import (
 type Interface interface {
 	// TrvsSecrets returns a TrvsSecretInformer.
 	TrvsSecrets() TrvsSecretInformer
+	// TrvsSecretPolicies returns a TrvsSecretPolicyInformer.
+	TrvsSecretPolicies() TrvsSecretPolicyInformer
 }
 
 type version struct {
@@ -43,3 +45,8 @@ func New(f internalinterfaces.SharedInformerFactory, namespace string, tweakList
 func (v *version) TrvsSecrets() TrvsSecretInformer {
 	return &trvsSecretInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
 }
+
+// TrvsSecretPolicies returns a TrvsSecretPolicyInformer.
+func (v *version) TrvsSecretPolicies() TrvsSecretPolicyInformer {
+	return &trvsSecretPolicyInformer{factory: v.factory, tweakListOptions: v.tweakListOptions}
+}
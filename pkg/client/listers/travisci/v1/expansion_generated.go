@@ -25,3 +25,7 @@ type TrvsSecretListerExpansion interface{}
 // TrvsSecretNamespaceListerExpansion allows custom methods to be added to
 // TrvsSecretNamespaceLister.
 type TrvsSecretNamespaceListerExpansion interface{}
+
+// TrvsSecretPolicyListerExpansion allows custom methods to be added to
+// TrvsSecretPolicyLister.
+type TrvsSecretPolicyListerExpansion interface{}
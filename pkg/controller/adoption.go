@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	"github.com/travis-ci/trvs-operator/pkg/trvssecret"
+)
+
+// backupOfLabel names the secret a backup was taken of.
+const backupOfLabel = "travisci.com/backup-of"
+
+const (
+	AdoptSecret        = "AdoptSecret"
+	MessageAdoptSecret = "Adopted existing secret %q, previous data is backed up in %q"
+)
+
+func backupSecretName(name string) string {
+	return name + "-pre-adoption"
+}
+
+// adoptSecret takes over an existing secret that isn't managed by ts, if ts
+// allows it. The secret's previous data is backed up to a sibling secret first.
+// The secret is updated in place, so it never goes missing.
+func (c *Controller) adoptSecret(ts *travisv1.TrvsSecret, secret *v1.Secret, generated map[string][]byte, commit string) (*v1.Secret, error) {
+	policy := ts.Spec.AdoptionPolicy
+	if policy != travisv1.AdoptionPolicyAdopt && policy != travisv1.AdoptionPolicyMerge {
+		c.recorder.Eventf(ts, v1.EventTypeWarning, ErrResourceExists, MessageResourceExists, secret.Name)
+		return nil, fmt.Errorf(MessageResourceExists, secret.Name)
+	}
+
+	// never steal a secret from another controller
+	if ref := metav1.GetControllerOf(secret); ref != nil {
+		c.recorder.Eventf(ts, v1.EventTypeWarning, ErrResourceExists, MessageResourceExists, secret.Name)
+		return nil, fmt.Errorf("secret %q is controlled by %s %q", secret.Name, ref.Kind, ref.Name)
+	}
+
+	entry := controllerLog.WithFields(log.Fields{
+		"namespace": secret.Namespace,
+		"name":      secret.Name,
+		"policy":    policy,
+	})
+
+	backup := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      backupSecretName(secret.Name),
+			Namespace: secret.Namespace,
+			Labels: map[string]string{
+				backupOfLabel: secret.Name,
+			},
+		},
+		Type: secret.Type,
+		Data: secret.Data,
+	}
+
+	// if a backup already exists, a previous adoption attempt got this far, so
+	// it holds the original data and must not be overwritten
+	_, err := c.kubeclient.CoreV1().Secrets(secret.Namespace).Create(backup)
+	if err != nil && !errors.IsAlreadyExists(err) {
+		entry.WithError(err).Error("could not back up secret before adopting it")
+		return nil, err
+	}
+
+	adopted, err := c.patchSecret(secret, secretPatch(secret, newSecret(ts, secret, generated, commit)))
+	if err != nil {
+		entry.WithError(err).Error("could not adopt secret")
+		return nil, err
+	}
+
+	entry.Info("adopted secret")
+	c.recorder.Eventf(ts, v1.EventTypeNormal, AdoptSecret, MessageAdoptSecret, secret.Name, backup.Name)
+	return adopted, nil
+}
+
+// secretData works out the data a secret should have. Only the merge adoption
+// policy keeps keys that weren't generated by the operator.
+func secretData(ts *travisv1.TrvsSecret, existing *v1.Secret, generated map[string][]byte) map[string][]byte {
+	if ts.Spec.AdoptionPolicy != travisv1.AdoptionPolicyMerge || existing == nil {
+		return generated
+	}
+
+	managed := make(map[string]bool)
+	if keys := existing.Annotations[trvssecret.ManagedKeysAnnotation]; keys != "" {
+		for _, k := range strings.Split(keys, ",") {
+			managed[k] = true
+		}
+	}
+
+	data := make(map[string][]byte)
+	for k, v := range existing.Data {
+		// keys the operator used to generate but doesn't anymore are dropped
+		if !managed[k] {
+			data[k] = v
+		}
+	}
+	for k, v := range generated {
+		data[k] = v
+	}
+
+	return data
+}
+
+func managedKeys(generated map[string][]byte) string {
+	keys := make([]string, 0, len(generated))
+	for k := range generated {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return strings.Join(keys, ",")
+}
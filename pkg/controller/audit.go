@@ -0,0 +1,397 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	travisclientset "github.com/travis-ci/trvs-operator/pkg/client/clientset/versioned"
+)
+
+// requestedByAnnotation names whoever asked for a TrvsSecret. It is used when
+// the API server doesn't track managed fields, which only started with
+// Kubernetes 1.18, so it has to be set by the requester or by whatever tooling
+// creates TrvsSecrets.
+const requestedByAnnotation = "travisci.com/requested-by"
+
+// Where the requester of an audit record came from.
+const (
+	RequesterFromManagedFields = "managedFields"
+	RequesterFromAnnotation    = "annotation"
+)
+
+// httpSinkQueueSize is how many audit records an HTTPSink holds while earlier
+// ones are being posted.
+const httpSinkQueueSize = 100
+
+const (
+	AuditCreate   = "create"
+	AuditUpdate   = "update"
+	AuditAdopt    = "adopt"
+	AuditRollback = "rollback"
+)
+
+// AuditRecord describes a change to the data of a generated secret. It only
+// ever holds hashes of values, never the values themselves.
+type AuditRecord struct {
+	Time           time.Time  `json:"time"`
+	Action         string     `json:"action"`
+	Namespace      string     `json:"namespace"`
+	Name           string     `json:"name"`
+	UID            types.UID  `json:"uid"`
+	Secret         string     `json:"secret"`
+	Requester      string     `json:"requester,omitempty"`
+	RequesterFrom  string     `json:"requesterFrom,omitempty"`
+	Keychain       string     `json:"keychain"`
+	KeychainCommit string     `json:"keychainCommit"`
+	Keys           []AuditKey `json:"keys"`
+}
+
+// AuditKey is a key of a secret that changed. Hash is empty for removed keys.
+type AuditKey struct {
+	Name string `json:"name"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// AuditSink receives audit records.
+type AuditSink interface {
+	Write(AuditRecord) error
+}
+
+// Auditor sends audit records to every configured sink.
+type Auditor struct {
+	// Sinks receive the records. Use SetSinks to change them once the
+	// Auditor is in use.
+	Sinks   []AuditSink
+	sinksMu sync.RWMutex
+
+	// Clock timestamps the records. The system clock is used if it is nil.
+	Clock clock.Clock
+
+	// Fetch returns a TrvsSecret as the API server stores it, so the
+	// requester can be taken from its managed fields, which the vendored API
+	// types drop. Only the requested-by annotation is used if it is nil.
+	Fetch func(namespace, name string) ([]byte, error)
+
+	// HashKey keys the HMAC the values in records are hashed with, so they
+	// can't be guessed by hashing candidates. A random key is used if it is
+	// empty, and then hashes can only be compared within one run.
+	HashKey []byte
+
+	keyOnce sync.Once
+	key     []byte
+}
+
+// FetchTrvsSecret fetches TrvsSecrets for Auditor.Fetch.
+func FetchTrvsSecret(client travisclientset.Interface) func(namespace, name string) ([]byte, error) {
+	return func(namespace, name string) ([]byte, error) {
+		return client.TravisciV1().RESTClient().Get().
+			Namespace(namespace).
+			Resource("trvssecrets").
+			Name(name).
+			DoRaw()
+	}
+}
+
+// SetSinks replaces the sinks, returning the old ones. No record is written to
+// the old sinks once it returns, so they can be closed.
+func (a *Auditor) SetSinks(sinks []AuditSink) []AuditSink {
+	a.sinksMu.Lock()
+	defer a.sinksMu.Unlock()
+
+	old := a.Sinks
+	a.Sinks = sinks
+	return old
+}
+
+// Record builds a record of the change from old to new data of a secret and
+// sends it to the sinks. Nothing is recorded if no key changed.
+func (a *Auditor) Record(action string, ts *travisv1.TrvsSecret, secret, commit string, old, new map[string][]byte) {
+	keys := auditKeys(a.hashKey(), old, new)
+	if len(keys) == 0 || len(a.sinks()) == 0 {
+		return
+	}
+
+	now := time.Now()
+	if a.Clock != nil {
+		now = a.Clock.Now()
+	}
+
+	requester, from := a.requester(ts)
+
+	record := AuditRecord{
+		Time:           now.UTC(),
+		Action:         action,
+		Namespace:      ts.Namespace,
+		Name:           ts.Name,
+		UID:            ts.UID,
+		Secret:         secret,
+		Requester:      requester,
+		RequesterFrom:  from,
+		Keychain:       keychainName(ts.Spec.IsPro),
+		KeychainCommit: commit,
+		Keys:           keys,
+	}
+
+	// held until the record is written, so SetSinks waits for it
+	a.sinksMu.RLock()
+	defer a.sinksMu.RUnlock()
+
+	for _, sink := range a.Sinks {
+		if err := sink.Write(record); err != nil {
+			controllerLog.WithError(err).WithFields(log.Fields{
+				"namespace": ts.Namespace,
+				"name":      ts.Name,
+				"sink":      fmt.Sprintf("%T", sink),
+			}).Error("could not write audit record")
+		}
+	}
+}
+
+func (a *Auditor) hashKey() []byte {
+	a.keyOnce.Do(func() {
+		a.key = a.HashKey
+		if len(a.key) > 0 {
+			return
+		}
+
+		a.key = make([]byte, 32)
+		if _, err := rand.Read(a.key); err != nil {
+			panic(fmt.Sprintf("could not generate audit hash key: %v", err))
+		}
+	})
+	return a.key
+}
+
+func (a *Auditor) sinks() []AuditSink {
+	a.sinksMu.RLock()
+	defer a.sinksMu.RUnlock()
+	return a.Sinks
+}
+
+// requester returns who asked for ts, and where that came from: the manager
+// of the last change to its spec, or else the requested-by annotation.
+func (a *Auditor) requester(ts *travisv1.TrvsSecret) (string, string) {
+	if a.Fetch != nil {
+		raw, err := a.Fetch(ts.Namespace, ts.Name)
+		if err != nil {
+			controllerLog.WithError(err).WithFields(log.Fields{
+				"namespace": ts.Namespace,
+				"name":      ts.Name,
+			}).Warn("could not fetch managed fields of TrvsSecret")
+		} else if manager := specManager(raw); manager != "" {
+			return manager, RequesterFromManagedFields
+		}
+	}
+
+	if requester := ts.Annotations[requestedByAnnotation]; requester != "" {
+		return requester, RequesterFromAnnotation
+	}
+
+	return "", ""
+}
+
+// managedFieldsEntry mirrors the parts of metav1.ManagedFieldsEntry, which
+// the vendored API doesn't have yet, that the requester is taken from.
+type managedFieldsEntry struct {
+	Manager     string                     `json:"manager"`
+	Subresource string                     `json:"subresource,omitempty"`
+	Time        metav1.Time                `json:"time,omitempty"`
+	FieldsV1    map[string]json.RawMessage `json:"fieldsV1,omitempty"`
+}
+
+// specManager returns the manager that last changed the spec of the object in
+// raw, or an empty string if the object has no managed fields.
+func specManager(raw []byte) string {
+	var object struct {
+		Metadata struct {
+			ManagedFields []managedFieldsEntry `json:"managedFields"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return ""
+	}
+
+	var latest *managedFieldsEntry
+	for i := range object.Metadata.ManagedFields {
+		e := &object.Metadata.ManagedFields[i]
+		if _, ok := e.FieldsV1["f:spec"]; !ok || e.Subresource != "" {
+			continue
+		}
+		if latest == nil || !e.Time.Before(&latest.Time) {
+			latest = e
+		}
+	}
+
+	if latest == nil {
+		return ""
+	}
+	return latest.Manager
+}
+
+func auditKeys(hashKey []byte, old, new map[string][]byte) []AuditKey {
+	var keys []AuditKey
+	for k, v := range new {
+		if o, ok := old[k]; !ok || !bytes.Equal(o, v) {
+			keys = append(keys, AuditKey{Name: k, Hash: valueHash(hashKey, v)})
+		}
+	}
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			keys = append(keys, AuditKey{Name: k})
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+	return keys
+}
+
+// valueHash identifies a value well enough to tell whether two records saw
+// the same one.
+func valueHash(key, v []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(v)
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WriterSink writes audit records as JSON lines.
+type WriterSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// NewFileSink appends audit records to a file, or writes them to stdout if
+// path is "-".
+func NewFileSink(path string) (*WriterSink, error) {
+	if path == "-" {
+		return NewWriterSink(os.Stdout), nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WriterSink{w: f, closer: f}, nil
+}
+
+// Close closes the file of a sink created by NewFileSink. Other writers are
+// left open.
+func (s *WriterSink) Close() {
+	if s.closer == nil {
+		return
+	}
+
+	if err := s.closer.Close(); err != nil {
+		controllerLog.WithError(err).Error("could not close audit log")
+	}
+}
+
+func (s *WriterSink) Write(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// HTTPSink posts each audit record as JSON to a URL. Records are posted in the
+// background, so a slow or unreachable endpoint doesn't hold up syncs.
+type HTTPSink struct {
+	URL    string
+	client *http.Client
+
+	queue chan AuditRecord
+	done  chan struct{}
+}
+
+func NewHTTPSink(url string) *HTTPSink {
+	s := &HTTPSink{
+		URL:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan AuditRecord, httpSinkQueueSize),
+		done:   make(chan struct{}),
+	}
+
+	go s.run()
+	return s
+}
+
+// Write queues record to be posted. It fails, dropping the record, if too
+// many records are already waiting.
+func (s *HTTPSink) Write(record AuditRecord) error {
+	select {
+	case s.queue <- record:
+		return nil
+	default:
+		return fmt.Errorf("%d audit records are already waiting to be posted", httpSinkQueueSize)
+	}
+}
+
+// Close stops the sink once every queued record has been posted. Nothing may
+// be written to it afterwards.
+func (s *HTTPSink) Close() {
+	close(s.queue)
+	<-s.done
+}
+
+func (s *HTTPSink) run() {
+	defer close(s.done)
+
+	for record := range s.queue {
+		if err := s.post(record); err != nil {
+			controllerLog.WithError(err).WithFields(log.Fields{
+				"namespace": record.Namespace,
+				"name":      record.Name,
+				"url":       s.URL,
+			}).Error("could not post audit record")
+		}
+	}
+}
+
+func (s *HTTPSink) post(record AuditRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("audit sink responded with %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+)
+
+// recordingSink keeps every audit record written to it.
+type recordingSink struct {
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+func (s *recordingSink) Write(record AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records = append(s.records, record)
+	return nil
+}
+
+// all returns the records written so far, while the sink is in use.
+func (s *recordingSink) all() []AuditRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]AuditRecord(nil), s.records...)
+}
+
+const managedTrvsSecret = `{
+  "metadata": {
+    "name": "app",
+    "managedFields": [
+      {"manager": "kubectl-client-side-apply", "operation": "Update", "time": "2020-05-01T10:00:00Z",
+       "fieldsV1": {"f:metadata": {}, "f:spec": {"f:app": {}}}},
+      {"manager": "helm", "operation": "Update", "time": "2020-05-02T10:00:00Z",
+       "fieldsV1": {"f:spec": {"f:env": {}}}},
+      {"manager": "trvs-operator", "operation": "Update", "time": "2020-05-03T10:00:00Z",
+       "fieldsV1": {"f:metadata": {"f:finalizers": {}}}},
+      {"manager": "trvs-operator", "operation": "Update", "subresource": "status", "time": "2020-05-03T10:00:00Z",
+       "fieldsV1": {"f:spec": {}, "f:status": {}}}
+    ]
+  }
+}`
+
+func TestAuditRequester(t *testing.T) {
+	ts := &travisv1.TrvsSecret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "app",
+			Annotations: map[string]string{requestedByAnnotation: "jane"},
+		},
+	}
+
+	for _, tt := range []struct {
+		name      string
+		fetch     func(namespace, name string) ([]byte, error)
+		requester string
+		from      string
+	}{
+		{
+			name: "managed fields",
+			fetch: func(namespace, name string) ([]byte, error) {
+				return []byte(managedTrvsSecret), nil
+			},
+			requester: "helm",
+			from:      RequesterFromManagedFields,
+		},
+		{
+			name: "no managed fields",
+			fetch: func(namespace, name string) ([]byte, error) {
+				return []byte(`{"metadata": {"name": "app"}}`), nil
+			},
+			requester: "jane",
+			from:      RequesterFromAnnotation,
+		},
+		{
+			name: "fetch failed",
+			fetch: func(namespace, name string) ([]byte, error) {
+				return nil, errors.New("forbidden")
+			},
+			requester: "jane",
+			from:      RequesterFromAnnotation,
+		},
+		{
+			name:      "no fetch",
+			requester: "jane",
+			from:      RequesterFromAnnotation,
+		},
+	} {
+		sink := &recordingSink{}
+		a := &Auditor{Sinks: []AuditSink{sink}, Clock: clock.NewFakeClock(time.Now()), Fetch: tt.fetch}
+		a.Record(AuditCreate, ts, "app", "abc", nil, map[string][]byte{"KEY": []byte("value")})
+
+		if len(sink.records) != 1 {
+			t.Fatalf("%s: got %d records, want 1", tt.name, len(sink.records))
+		}
+		r := sink.records[0]
+		if r.Requester != tt.requester || r.RequesterFrom != tt.from {
+			t.Errorf("%s: requester is %q from %q, want %q from %q", tt.name, r.Requester, r.RequesterFrom, tt.requester, tt.from)
+		}
+	}
+}
+
+func TestHTTPSinkPostsInBackground(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var posted []AuditRecord
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+
+		var record AuditRecord
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			t.Errorf("could not decode posted record: %v", err)
+		}
+
+		mu.Lock()
+		posted = append(posted, record)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	sink := NewHTTPSink(server.URL)
+
+	// the endpoint doesn't answer until released, so writes must not wait
+	// for it
+	written := make(chan error)
+	go func() {
+		for _, name := range []string{"a", "b", "c"} {
+			if err := sink.Write(AuditRecord{Name: name}); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write waited for the endpoint")
+	}
+
+	close(release)
+	sink.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(posted) != 3 || posted[0].Name != "a" || posted[2].Name != "c" {
+		t.Fatalf("posted %+v, want records a, b and c in order", posted)
+	}
+}
+
+func TestHTTPSinkDropsWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	sink := NewHTTPSink(server.URL)
+
+	var err error
+	for i := 0; i <= httpSinkQueueSize+1 && err == nil; i++ {
+		err = sink.Write(AuditRecord{})
+	}
+	if err == nil {
+		t.Fatal("Write kept queueing records for an endpoint that doesn't answer")
+	}
+
+	close(release)
+	sink.Close()
+}
+
+func TestAuditHashesAreKeyed(t *testing.T) {
+	ts := &travisv1.TrvsSecret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"}}
+	data := map[string][]byte{"PORT": []byte("5432")}
+
+	hash := func(a *Auditor) string {
+		sink := &recordingSink{}
+		a.Sinks = []AuditSink{sink}
+		a.Record(AuditCreate, ts, "app", "abc", nil, data)
+		a.Record(AuditCreate, ts, "app", "abc", nil, data)
+
+		records := sink.all()
+		if len(records) != 2 || records[0].Keys[0].Hash != records[1].Keys[0].Hash {
+			t.Fatalf("the same value was recorded as %+v", records)
+		}
+		return records[0].Keys[0].Hash
+	}
+
+	plain := sha256.Sum256([]byte("5432"))
+	keyed := hash(&Auditor{HashKey: []byte("key")})
+	if strings.Contains(keyed, hex.EncodeToString(plain[:])) {
+		t.Errorf("value was hashed without a key: %s", keyed)
+	}
+	if hash(&Auditor{HashKey: []byte("key")}) != keyed {
+		t.Error("the same key hashed the value differently")
+	}
+	if hash(&Auditor{HashKey: []byte("other key")}) == keyed {
+		t.Error("different keys hashed the value the same")
+	}
+	if hash(&Auditor{}) == hash(&Auditor{}) {
+		t.Error("auditors without a key share one")
+	}
+}
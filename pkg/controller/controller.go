@@ -0,0 +1,778 @@
+// Package controller reconciles TrvsSecrets into the secrets generated for
+// them.
+package controller
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	travisclientset "github.com/travis-ci/trvs-operator/pkg/client/clientset/versioned"
+	travisscheme "github.com/travis-ci/trvs-operator/pkg/client/clientset/versioned/scheme"
+	informers "github.com/travis-ci/trvs-operator/pkg/client/informers/externalversions/travisci/v1"
+	listers "github.com/travis-ci/trvs-operator/pkg/client/listers/travisci/v1"
+	"github.com/travis-ci/trvs-operator/pkg/keychain"
+	"github.com/travis-ci/trvs-operator/pkg/logging"
+	"github.com/travis-ci/trvs-operator/pkg/trvssecret"
+)
+
+var controllerLog = logging.Subsystem("controller")
+
+const controllerAgentName = "trvs-operator"
+
+const (
+	ErrResourceExists     = "ErrResourceExists"
+	MessageResourceExists = "Secret %q already exists and is not managed by a TrvsSecret"
+)
+
+// Generator produces the data of the secrets. *trvs.Trvs implements it.
+type Generator interface {
+	// Generate returns the data for spec, along with the keychain commit it
+	// was generated from.
+	Generate(spec travisv1.TrvsSecretSpec) (map[string][]byte, string, error)
+
+	// Regenerate is like Generate, but must not reuse earlier output.
+	Regenerate(spec travisv1.TrvsSecretSpec) (map[string][]byte, string, error)
+
+	// Watch checks for changes every d until ctx is done, and calls handler
+	// whenever any generated data may have changed.
+	Watch(ctx context.Context, d time.Duration, handler func())
+}
+
+// Keychains tracks the keychains the data is generated from.
+// keychain.Keychains implements it.
+type Keychains interface {
+	// Watch checks for changes every d until ctx is done, and calls handler
+	// with every change pulled into a keychain.
+	Watch(ctx context.Context, d time.Duration, handler func(*keychain.Change))
+
+	// Update pulls the latest commits of the keychain for .com if isPro is
+	// set, or the one for .org otherwise. It returns nil if nothing changed.
+	Update(isPro bool) (*keychain.Change, error)
+}
+
+// Authorizer decides whether a TrvsSecret may be generated.
+// *PolicyAuthorizer implements it.
+type Authorizer interface {
+	HasSynced() bool
+
+	// Authorize returns why a TrvsSecret with spec isn't allowed in
+	// namespace, or an empty string if it is.
+	Authorize(namespace string, spec travisv1.TrvsSecretSpec) (string, error)
+}
+
+// allowAll is the Authorizer used when none is given.
+type allowAll struct{}
+
+func (allowAll) HasSynced() bool { return true }
+
+func (allowAll) Authorize(string, travisv1.TrvsSecretSpec) (string, error) { return "", nil }
+
+// Notifier is told how every sync of a TrvsSecret turned out.
+// *notify.Notifier implements it.
+type Notifier interface {
+	SyncFailed(namespace, name string, err error)
+	SyncSucceeded(namespace, name string)
+
+	// Forget is called once a TrvsSecret no longer exists.
+	Forget(namespace, name string)
+}
+
+// noNotifier is the Notifier used when none is given.
+type noNotifier struct{}
+
+func (noNotifier) SyncFailed(string, string, error) {}
+
+func (noNotifier) SyncSucceeded(string, string) {}
+
+func (noNotifier) Forget(string, string) {}
+
+// Option configures an optional part of a Controller.
+type Option func(*Controller)
+
+// WithClock sets the clock used for timestamps and retention. It defaults to
+// the system clock.
+func WithClock(clock clock.Clock) Option {
+	return func(c *Controller) { c.clock = clock }
+}
+
+// WithSyncPeriod sets how often the keychains and trvs are checked for
+// changes. It defaults to a minute.
+func WithSyncPeriod(d time.Duration) Option {
+	return func(c *Controller) { c.keychainSyncPeriod = d }
+}
+
+// WithSweep enables the cleanup of orphaned secrets.
+func WithSweep(sweep SweepOptions) Option {
+	return func(c *Controller) { c.sweep = sweep }
+}
+
+// WithAuthorizer restricts which TrvsSecrets are generated. Everything is
+// allowed by default.
+func WithAuthorizer(a Authorizer) Option {
+	return func(c *Controller) { c.policies = a }
+}
+
+// WithAuditor records changes to the generated secrets.
+func WithAuditor(a *Auditor) Option {
+	return func(c *Controller) { c.audit = a }
+}
+
+// WithNotifier reports the outcome of every sync.
+func WithNotifier(n Notifier) Option {
+	return func(c *Controller) { c.notifier = n }
+}
+
+// WithMetrics sets what the controller counts in. It defaults to
+// DefaultMetrics.
+func WithMetrics(m *Metrics) Option {
+	return func(c *Controller) { c.metrics = m }
+}
+
+// WithRedactor sets what is told about the values of every generated secret,
+// so they can be redacted. It defaults to logging.Secrets, which is what the
+// loggers use.
+func WithRedactor(r *logging.Redactor) Option {
+	return func(c *Controller) { c.redactor = r }
+}
+
+// WithQueue tunes how TrvsSecrets are retried. It defaults to
+// DefaultQueueOptions.
+func WithQueue(queue QueueOptions) Option {
+	return func(c *Controller) { c.queue = queue }
+}
+
+// New creates a controller that generates secrets with generator from the
+// given keychains, for the TrvsSecrets and secrets seen by the informers.
+func New(
+	generator Generator,
+	keychains Keychains,
+	kubeclient kubernetes.Interface,
+	travisclient travisclientset.Interface,
+	secretInformers []coreinformers.SecretInformer,
+	trvsSecretInformers []informers.TrvsSecretInformer,
+	opts ...Option) *Controller {
+
+	runtime.Must(travisscheme.AddToScheme(scheme.Scheme))
+	controllerLog.Info("creating event recorder")
+	eb := record.NewBroadcaster()
+	eb.StartLogging(controllerLog.WithField("type", "events").Infof)
+	eb.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: kubeclient.CoreV1().Events(""),
+	})
+
+	recorder := eb.NewRecorder(scheme.Scheme, v1.EventSource{
+		Component: controllerAgentName,
+	})
+
+	controller := &Controller{
+		generator:          generator,
+		keychains:          keychains,
+		keychainSyncPeriod: time.Minute,
+		policies:           allowAll{},
+		audit:              &Auditor{},
+		notifier:           noNotifier{},
+		queue:              DefaultQueueOptions,
+		clock:              clock.RealClock{},
+		redactor:           logging.Secrets,
+		kubeclient:         kubeclient,
+		travisclient:       travisclient,
+		bulk:               workqueue.NewNamed("BulkTrvsSecrets"),
+		recorder:           recorder,
+		triggers:           make(map[string]string),
+		sweepChanged:       make(chan struct{}, 1),
+		workTaken:          make(chan struct{}, 1),
+	}
+
+	for _, opt := range opts {
+		opt(controller)
+	}
+	if controller.metrics == nil {
+		controller.metrics = DefaultMetrics()
+	}
+	if controller.audit.Clock == nil {
+		controller.audit.Clock = controller.clock
+	}
+
+	controller.workqueue = workqueue.NewNamedRateLimitingQueue(controller.queue.rateLimiter(), "TrvsSecrets")
+
+	var secretsLister multiSecretLister
+	for _, informer := range secretInformers {
+		secretsLister = append(secretsLister, informer.Lister())
+		controller.cacheSynced = append(controller.cacheSynced, informer.Informer().HasSynced)
+		informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: controller.handleObject,
+			UpdateFunc: func(old, new interface{}) {
+				oldSec := old.(*v1.Secret)
+				newSec := new.(*v1.Secret)
+				if newSec.ResourceVersion == oldSec.ResourceVersion {
+					// Ignore the update if the secret hasn't actually changed.
+					//
+					// This is needed because the UpdateFunc is called periodically even when there
+					// are no changes, so updates aren't missed. We already get those updates from the
+					// other informer, though, so this is redundant.
+					return
+				}
+
+				controller.handleObject(new)
+			},
+			DeleteFunc: controller.handleObject,
+		})
+	}
+	controller.secretsLister = secretsLister
+
+	var trvsLister multiTrvsSecretLister
+	for _, informer := range trvsSecretInformers {
+		trvsLister = append(trvsLister, informer.Lister())
+		controller.cacheSynced = append(controller.cacheSynced, informer.Informer().HasSynced)
+		informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: controller.enqueueTrvsSecret,
+			UpdateFunc: func(old, new interface{}) {
+				// periodic resyncs can wait for changes made by users
+				if old.(*travisv1.TrvsSecret).ResourceVersion == new.(*travisv1.TrvsSecret).ResourceVersion {
+					controller.enqueueBulk(new)
+					return
+				}
+				controller.enqueueTrvsSecret(new)
+			},
+			// so whatever is kept about it is forgotten
+			DeleteFunc: controller.enqueueDeletedTrvsSecret,
+		})
+	}
+	controller.trvsLister = trvsLister
+
+	return controller
+}
+
+type Controller struct {
+	generator          Generator
+	keychains          Keychains
+	keychainSyncPeriod time.Duration
+	policies           Authorizer
+	audit              *Auditor
+	notifier           Notifier
+	queue              QueueOptions
+	clock              clock.Clock
+	metrics            *Metrics
+	redactor           *logging.Redactor
+
+	kubeclient   kubernetes.Interface
+	travisclient travisclientset.Interface
+
+	secretsLister corelisters.SecretLister
+	trvsLister    listers.TrvsSecretLister
+	cacheSynced   []cache.InformerSynced
+
+	workqueue workqueue.RateLimitingInterface
+	bulk      workqueue.Interface
+	recorder  record.EventRecorder
+
+	// workTaken wakes the bulk feeder when a worker takes an item off the
+	// workqueue, making room for another
+	workTaken chan struct{}
+
+	sweepMu      sync.Mutex
+	sweep        SweepOptions
+	sweepChanged chan struct{}
+
+	// triggers records which keychain commit caused a TrvsSecret to be enqueued
+	triggersMu sync.Mutex
+	triggers   map[string]string
+}
+
+// Run processes TrvsSecrets with the given number of workers until ctx is
+// done. It then stops taking new work and waits up to gracePeriod for
+// in-flight reconciles and keychain updates to finish before returning. If
+// they don't, it returns an error without waiting for them any longer.
+func (c *Controller) Run(ctx context.Context, threads int, gracePeriod time.Duration) error {
+	defer runtime.HandleCrash()
+
+	controllerLog.Info("starting controller")
+
+	controllerLog.Info("waiting for informer caches to sync")
+	synced := append([]cache.InformerSynced{c.policies.HasSynced}, c.cacheSynced...)
+	if ok := cache.WaitForCacheSync(ctx.Done(), synced...); !ok {
+		c.workqueue.ShutDown()
+		return fmt.Errorf("failed waiting for caches to sync")
+	}
+
+	var wg sync.WaitGroup
+
+	// only start watching the repos once the caches are synced, so that
+	// changes are fanned out to every existing TrvsSecret
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		c.runBulkFeeder(ctx, threads)
+	}()
+	go func() {
+		defer wg.Done()
+		c.keychains.Watch(ctx, c.keychainSyncPeriod, c.enqueueKeychainSecrets)
+	}()
+	go func() {
+		defer wg.Done()
+		c.generator.Watch(ctx, c.keychainSyncPeriod, c.enqueueGeneratedSecrets)
+	}()
+	go func() {
+		defer wg.Done()
+		c.runSweeper(ctx)
+	}()
+
+	entry := controllerLog.WithField("count", threads)
+	entry.Info("starting workers")
+
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait.Until(func() { c.runWorker(ctx) }, time.Second, ctx.Done())
+		}()
+	}
+
+	entry.Info("started workers")
+	<-ctx.Done()
+	entry.Info("stopping workers")
+
+	// unblock workers waiting for new items
+	c.workqueue.ShutDown()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		entry.Info("stopped workers")
+	case <-time.After(gracePeriod):
+		return fmt.Errorf("workers didn't stop within the grace period of %v", gracePeriod)
+	}
+
+	return nil
+}
+
+func (c *Controller) runWorker(ctx context.Context) {
+	for ctx.Err() == nil && c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	obj, shutdown := c.workqueue.Get()
+	if shutdown {
+		return false
+	}
+
+	select {
+	case c.workTaken <- struct{}{}:
+	default:
+	}
+
+	func(obj interface{}) {
+		defer c.workqueue.Done(obj)
+
+		var key string
+		var ok bool
+
+		if key, ok = obj.(string); !ok {
+			c.workqueue.Forget(obj)
+			controllerLog.WithField("value", obj).Error("unexpected value in workqueue")
+			return
+		}
+
+		entry := controllerLog.WithField("key", key)
+
+		entry.Info("got workqueue item")
+		namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+		if err := c.syncHandler(key); err != nil {
+			c.workqueue.AddRateLimited(key)
+			entry.WithError(err).Error("could not process item")
+			c.notifier.SyncFailed(namespace, name, err)
+			return
+		}
+
+		c.workqueue.Forget(obj)
+		entry.Info("synced secret")
+		c.notifier.SyncSucceeded(namespace, name)
+	}(obj)
+
+	return true
+}
+
+func (c *Controller) syncHandler(key string) error {
+	entry := controllerLog.WithField("key", key)
+	trigger := c.popTrigger(key)
+	if trigger != "" {
+		entry = entry.WithField("keychain_commit", trigger)
+	}
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		entry.Error("invalid resource key")
+		return nil
+	}
+
+	ts, err := c.trvsLister.TrvsSecrets(namespace).Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			entry.Info("resource no longer exists")
+			c.redactor.Remove(key)
+			c.notifier.Forget(namespace, name)
+			return nil
+		}
+
+		return err
+	}
+
+	if ts.DeletionTimestamp != nil {
+		return c.finalize(ts)
+	}
+
+	entry = entry.WithFields(log.Fields{
+		"namespace": ts.Namespace,
+		"name":      ts.Name,
+		"app":       ts.Spec.App,
+		"env":       ts.Spec.Environment,
+	})
+	entry.Info("checking secret")
+
+	// before anything is written to the TrvsSecret, so a forbidden one gets
+	// its condition even if the admission webhook would reject the update
+	reason, err := c.policies.Authorize(ts.Namespace, ts.Spec)
+	if err != nil {
+		entry.WithError(err).Error("could not check policies")
+		return err
+	}
+	if reason != "" {
+		entry.WithField("reason", reason).Warn("secret is not allowed by any policy")
+		c.recorder.Event(ts, v1.EventTypeWarning, Forbidden, reason)
+		return c.updateStatus(ts, func(status *travisv1.TrvsSecretStatus) {
+			setCondition(status, c.clock.Now(), travisv1.TrvsSecretForbidden, v1.ConditionTrue, "PolicyDenied", reason)
+		})
+	}
+
+	ts, err = c.syncFinalizer(ts)
+	if err != nil {
+		entry.WithError(err).Error("could not update finalizer")
+		return err
+	}
+
+	if ts.Spec.Suspend {
+		entry.Info("reconciling is suspended")
+		return c.updateStatus(ts, func(status *travisv1.TrvsSecretStatus) {
+			status.Suspended = true
+		})
+	}
+
+	var secretValues map[string][]byte
+	var commit string
+
+	rollbackTo := ts.Spec.RollbackTo
+	resyncAt := resyncRequested(ts)
+	switch {
+	case rollbackTo != "":
+		entry = entry.WithField("revision", rollbackTo)
+		secretValues, commit, err = c.rollback(ts, rollbackTo)
+		if err != nil {
+			entry.WithError(err).Error("could not get revision to roll back to")
+			return err
+		}
+	case resyncAt != "":
+		entry = entry.WithField("resync_at", resyncAt)
+		entry.Info("forcing resync")
+		secretValues, commit, err = c.resync(ts)
+	default:
+		secretValues, commit, err = c.generator.Generate(ts.Spec)
+	}
+	if err != nil {
+		entry.WithError(err).Error("could not get secret data from keychain")
+		return err
+	}
+
+	// anything logged from here on could contain these
+	c.redactor.Set(key, secretValues)
+
+	entry.WithFields(log.Fields{
+		"keys":   len(secretValues),
+		"commit": commit,
+	}).Info("found secret data in keychain")
+
+	var updated bool
+	var edits drift
+	if ts.Spec.Immutable {
+		updated, err = c.syncImmutableSecret(ts, entry, secretValues, commit, resyncAt != "")
+	} else {
+		updated, edits, err = c.syncSecret(ts, entry, secretValues, commit, trigger)
+	}
+	if err != nil {
+		return err
+	}
+
+	current := currentSecretName(ts, secretValues)
+	if rollbackTo != "" {
+		if updated {
+			c.recorder.Eventf(ts, v1.EventTypeNormal, RollbackSecret, MessageRollbackSecret, current, rollbackTo)
+		}
+	} else if !ts.Spec.Immutable {
+		// immutable secrets are revisions themselves
+		if err := c.recordRevision(ts, secretValues, commit); err != nil {
+			return err
+		}
+	}
+
+	return c.updateStatus(ts, func(status *travisv1.TrvsSecretStatus) {
+		status.Suspended = false
+		status.KeychainCommit = commit
+		status.Revision = trvssecret.Revision(secretValues)
+		status.PinnedRevision = rollbackTo
+		status.CurrentSecret = current
+		setCondition(status, c.clock.Now(), travisv1.TrvsSecretForbidden, v1.ConditionFalse, "PolicyAllowed", "")
+		setDriftCondition(status, c.clock.Now(), edits)
+		if resyncAt != "" {
+			status.LastResyncAt = resyncAt
+		}
+		if updated {
+			now := metav1.NewTime(c.clock.Now())
+			status.LastUpdateTime = &now
+		}
+	})
+}
+
+// syncSecret brings the secret of ts in line with the generated data. It
+// reports whether the secret was changed, and any edits found in it.
+func (c *Controller) syncSecret(ts *travisv1.TrvsSecret, entry *log.Entry, secretValues map[string][]byte, commit, trigger string) (bool, drift, error) {
+	secret, err := c.secretsLister.Secrets(ts.Namespace).Get(secretName(ts))
+	if errors.IsNotFound(err) {
+		secret, err = c.kubeclient.CoreV1().Secrets(ts.Namespace).Create(newSecret(ts, nil, secretValues, commit))
+		if err == nil {
+			c.recorder.Eventf(ts, v1.EventTypeNormal, "CreateSecret", "Created secret: %s", secret.Name)
+			c.audit.Record(AuditCreate, ts, secret.Name, commit, nil, secret.Data)
+			return true, drift{}, nil
+		}
+	}
+
+	if err != nil {
+		entry.WithError(err).Error("could not find/create secret")
+		return false, drift{}, err
+	}
+
+	if !metav1.IsControlledBy(secret, ts) {
+		adopted, err := c.adoptSecret(ts, secret, secretValues, commit)
+		if err != nil {
+			return false, drift{}, err
+		}
+
+		c.audit.Record(AuditAdopt, ts, secret.Name, commit, secret.Data, adopted.Data)
+		return true, drift{}, nil
+	}
+
+	desired := newSecret(ts, secret, secretValues, commit)
+	edits := c.checkDrift(ts, secret, desired)
+	if edits.hash != "" && ts.Spec.DriftPolicy == travisv1.DriftPolicyPause {
+		entry.Info("leaving edited secret alone")
+		return false, edits, nil
+	}
+
+	patch := secretPatch(secret, desired)
+	if len(patch) == 0 {
+		entry.Info("secret is already up-to-date")
+		return false, drift{}, nil
+	}
+
+	entry.Info("updating secret")
+	old := secret.Data
+	secret, err = c.patchSecret(secret, patch)
+	if err != nil {
+		return false, drift{}, err
+	}
+
+	action := AuditUpdate
+	if ts.Spec.RollbackTo != "" {
+		action = AuditRollback
+	}
+	c.audit.Record(action, ts, secret.Name, commit, old, secret.Data)
+
+	if trigger != "" {
+		c.recorder.Eventf(ts, v1.EventTypeNormal, "UpdateSecret", "Updated secret: %s (keychain commit %s)", secret.Name, trigger)
+	} else {
+		c.recorder.Eventf(ts, v1.EventTypeNormal, "UpdateSecret", "Updated secret: %s", secret.Name)
+	}
+	return true, drift{}, nil
+}
+
+func (c *Controller) enqueueTrvsSecret(obj interface{}) {
+	var key string
+	var err error
+	if key, err = cache.MetaNamespaceKeyFunc(obj); err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.workqueue.Add(key)
+}
+
+func (c *Controller) enqueueDeletedTrvsSecret(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.workqueue.Add(key)
+}
+
+func (c *Controller) handleObject(obj interface{}) {
+	var object metav1.Object
+	var ok bool
+
+	if object, ok = obj.(metav1.Object); !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			controllerLog.Error("could not decode secret object")
+			return
+		}
+
+		object, ok = tombstone.Obj.(metav1.Object)
+		if !ok {
+			controllerLog.Error("could not decode tombstone object")
+			return
+		}
+
+		controllerLog.Info("recovered secret from tombstone")
+	}
+
+	controllerLog.WithField("name", object.GetName()).Info("finding original of secret")
+	if ownerRef := metav1.GetControllerOf(object); ownerRef != nil {
+		if ownerRef.Kind != "TrvsSecret" {
+			return
+		}
+
+		ts, err := c.trvsLister.TrvsSecrets(object.GetNamespace()).Get(ownerRef.Name)
+		if err != nil {
+			controllerLog.WithFields(log.Fields{
+				"self":  object.GetSelfLink(),
+				"owner": ownerRef.Name,
+			}).Warn("ignoring orphaned secret")
+			return
+		}
+
+		c.enqueueTrvsSecret(ts)
+	}
+}
+
+func (c *Controller) enqueueKeychainSecrets(change *keychain.Change) {
+	entry := controllerLog.WithFields(log.Fields{
+		"keychain": change.Keychain,
+		"commit":   change.To,
+	})
+
+	secrets, err := c.trvsLister.List(labels.Everything())
+	if err != nil {
+		entry.WithError(err).Error("could not fetch existing secrets")
+		return
+	}
+
+	count := 0
+	for _, ts := range secrets {
+		// if the secret matches this keychain and depends on a changed file,
+		// enqueue it so we check for updates
+		if ts.Spec.IsPro != change.IsPro || !change.Affects(ts.Spec) {
+			continue
+		}
+
+		key, err := cache.MetaNamespaceKeyFunc(ts)
+		if err != nil {
+			runtime.HandleError(err)
+			continue
+		}
+
+		c.triggersMu.Lock()
+		c.triggers[key] = change.To
+		c.triggersMu.Unlock()
+
+		c.enqueueBulk(ts)
+		count++
+	}
+
+	entry.WithField("count", count).Info("enqueued secrets affected by keychain change")
+}
+
+// enqueueGeneratedSecrets enqueues every TrvsSecret whose data is generated by
+// trvs, rather than read from a keychain file, for when trvs itself changes.
+func (c *Controller) enqueueGeneratedSecrets() {
+	secrets, err := c.trvsLister.List(labels.Everything())
+	if err != nil {
+		controllerLog.WithError(err).Error("could not fetch existing secrets")
+		return
+	}
+
+	for _, ts := range secrets {
+		if ts.Spec.File == "" {
+			c.enqueueBulk(ts)
+		}
+	}
+}
+
+// popTrigger returns the keychain commit that caused key to be enqueued, if any,
+// and forgets about it.
+func (c *Controller) popTrigger(key string) string {
+	c.triggersMu.Lock()
+	defer c.triggersMu.Unlock()
+
+	commit := c.triggers[key]
+	delete(c.triggers, key)
+	return commit
+}
+
+// secretName is the name of the secret generated for a TrvsSecret.
+func secretName(ts *travisv1.TrvsSecret) string {
+	return ts.Name
+}
+
+// newSecret builds the secret for ts from the generated data. existing is the
+// current secret, if there is one.
+func newSecret(ts *travisv1.TrvsSecret, existing *v1.Secret, generated map[string][]byte, commit string) *v1.Secret {
+	data := secretData(ts, existing, generated)
+
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName(ts),
+			Namespace: ts.Namespace,
+			Labels: map[string]string{
+				managedByLabel:        controllerAgentName,
+				trvssecret.OwnerLabel: ts.Name,
+			},
+			Annotations: map[string]string{
+				trvssecret.KeychainCommitAnnotation: commit,
+				trvssecret.ManagedKeysAnnotation:    managedKeys(generated),
+				trvssecret.DataHashAnnotation:       trvssecret.DataHash(data),
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(ts, schema.GroupVersionKind{
+					Group:   travisv1.SchemeGroupVersion.Group,
+					Version: travisv1.SchemeGroupVersion.Version,
+					Kind:    "TrvsSecret",
+				}),
+			},
+		},
+		Data: data,
+	}
+}
@@ -0,0 +1,636 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubeinformers "k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/travis-ci/trvs-operator/internal/gittest"
+	"github.com/travis-ci/trvs-operator/internal/kubetest"
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	travisclientset "github.com/travis-ci/trvs-operator/pkg/client/clientset/versioned"
+	travisinformers "github.com/travis-ci/trvs-operator/pkg/client/informers/externalversions"
+	informers "github.com/travis-ci/trvs-operator/pkg/client/informers/externalversions/travisci/v1"
+	"github.com/travis-ci/trvs-operator/pkg/gitrepo"
+	"github.com/travis-ci/trvs-operator/pkg/keychain"
+	"github.com/travis-ci/trvs-operator/pkg/logging"
+	"github.com/travis-ci/trvs-operator/pkg/trvs"
+	"github.com/travis-ci/trvs-operator/pkg/trvssecret"
+)
+
+// stubTrvs stands in for trvs, printing APP/ENV.FORMAT from the keychain
+// instead of generating config.
+const stubTrvs = `#!/bin/sh
+keychain=travis-keychain
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-f) format=$2; shift ;;
+	-a) app=$2; shift ;;
+	-e) env=$2; shift ;;
+	--pro) keychain=travis-pro-keychain ;;
+	esac
+	shift
+done
+# the slow app takes as long as $SLOW_TRVS exists
+while [ "$app" = slow ] && [ -e "$SLOW_TRVS" ]; do sleep 0.05; done
+exec cat "$TRAVIS_KEYCHAIN_DIR/$keychain/$app/$env.$format"
+`
+
+// gracePeriod is how long the controllers under test get to stop.
+const gracePeriod = time.Second
+
+const namespace = "default"
+
+// harness runs a Controller against fake clientsets or an API server, with
+// the keychains and trvs in local Git repositories.
+type harness struct {
+	t      *testing.T
+	kube   kubernetes.Interface
+	travis travisclientset.Interface
+
+	// namespace is the only one the controller watches
+	namespace string
+
+	// redactor and metrics are the controller's and trvs' own, so tests
+	// don't share them
+	redactor    *logging.Redactor
+	metrics     *Metrics
+	trvsMetrics *trvs.Metrics
+
+	// org and com are the keychains, which can be committed to
+	org, com *gittest.Remote
+
+	cancel func()
+	done   chan struct{}
+	err    error
+	path   string
+}
+
+// newHarness runs a Controller against fake clientsets.
+func newHarness(t *testing.T, dir string, opts ...Option) *harness {
+	return startHarness(t, dir, kubetest.NewClientset(), kubetest.NewTravisClientset(), namespace, opts...)
+}
+
+// startHarness runs a Controller against the given clientsets, watching the
+// TrvsSecrets and secrets in namespace.
+func startHarness(t *testing.T, dir string, kube kubernetes.Interface, travis travisclientset.Interface, namespace string, opts ...Option) *harness {
+	h := &harness{
+		t:         t,
+		kube:      kube,
+		travis:    travis,
+		namespace: namespace,
+
+		redactor:    &logging.Redactor{},
+		metrics:     &Metrics{},
+		trvsMetrics: &trvs.Metrics{},
+
+		done: make(chan struct{}),
+		path: os.Getenv("PATH"),
+	}
+
+	// trvs dependencies are installed with bundler
+	bin := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bin, "bundle"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+h.path)
+
+	h.org = gittest.NewRemote(t, filepath.Join(dir, "remotes", "org"), "main", map[string]string{
+		"app/production.json": `{"database_url": "postgres://org-production"}`,
+	})
+	h.com = gittest.NewRemote(t, filepath.Join(dir, "remotes", "com"), "main", map[string]string{
+		"app/production.json": `{"database_url": "postgres://com-production"}`,
+	})
+	trvsRemote := gittest.NewRemote(t, filepath.Join(dir, "remotes", "trvs"), "main", map[string]string{
+		"bin/trvs":     stubTrvs,
+		"Gemfile.lock": "GEM\n",
+	})
+
+	keychainDir := filepath.Join(dir, "keychains")
+	newKeychain := func(name string, remote *gittest.Remote) *keychain.Keychain {
+		repo := gitrepo.New(filepath.Join(keychainDir, name), remote.URL, gitrepo.NoAuth, gitrepo.Options{})
+		k, err := keychain.New(name, keychainDir, repo)
+		if err != nil {
+			t.Fatalf("could not create keychain %s: %v", name, err)
+		}
+		return k
+	}
+	keychains := keychain.Keychains{
+		Org: newKeychain("travis-keychain", h.org),
+		Com: newKeychain("travis-pro-keychain", h.com),
+	}
+
+	trvsOpts := []trvs.Option{trvs.WithRedactor(h.redactor), trvs.WithMetrics(h.trvsMetrics)}
+	cache, err := trvs.NewCache("", trvsOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := gitrepo.New(filepath.Join(dir, "trvs", "repo"), trvsRemote.URL, gitrepo.NoAuth, gitrepo.Options{})
+	generator, err := trvs.New(filepath.Join(dir, "trvs"), repo, keychains, cache, 2, trvsOpts...)
+	if err != nil {
+		t.Fatalf("could not set up trvs: %v", err)
+	}
+
+	kf := kubeinformers.NewFilteredSharedInformerFactory(h.kube, 0, namespace, nil)
+	tf := travisinformers.NewFilteredSharedInformerFactory(h.travis, 0, namespace, nil)
+
+	c := New(generator, keychains, h.kube, h.travis,
+		[]coreinformers.SecretInformer{kf.Core().V1().Secrets()},
+		[]informers.TrvsSecretInformer{tf.Travisci().V1().TrvsSecrets()},
+		append([]Option{
+			WithSyncPeriod(50 * time.Millisecond),
+			WithRedactor(h.redactor),
+			WithMetrics(h.metrics),
+		}, opts...)...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	kf.Start(ctx.Done())
+	tf.Start(ctx.Done())
+
+	go func() {
+		defer close(h.done)
+		h.err = c.Run(ctx, 2, gracePeriod)
+	}()
+
+	return h
+}
+
+func (h *harness) stop() {
+	if err := h.shutdown(); err != nil {
+		h.t.Errorf("Run: %v", err)
+	}
+}
+
+// shutdown stops the controller and returns what Run returned.
+func (h *harness) shutdown() error {
+	h.cancel()
+	<-h.done
+	os.Setenv("PATH", h.path)
+	return h.err
+}
+
+func (h *harness) create(ts *travisv1.TrvsSecret) *travisv1.TrvsSecret {
+	h.t.Helper()
+
+	ts.Namespace = h.namespace
+	created, err := h.travis.TravisciV1().TrvsSecrets(h.namespace).Create(ts)
+	if err != nil {
+		h.t.Fatalf("could not create TrvsSecret: %v", err)
+	}
+	return created
+}
+
+func (h *harness) trvsSecret(name string) *travisv1.TrvsSecret {
+	h.t.Helper()
+
+	ts, err := h.travis.TravisciV1().TrvsSecrets(h.namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		h.t.Fatalf("could not get TrvsSecret %s: %v", name, err)
+	}
+	return ts
+}
+
+// waitFor waits until cond holds, failing the test if it doesn't soon.
+func (h *harness) waitFor(what string, cond func() bool) {
+	h.t.Helper()
+
+	if err := wait.PollImmediate(20*time.Millisecond, 20*time.Second, func() (bool, error) {
+		return cond(), nil
+	}); err != nil {
+		h.t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// waitForData waits until the named secret holds value in key.
+func (h *harness) waitForData(name, key, value string) *v1.Secret {
+	h.t.Helper()
+
+	var secret *v1.Secret
+	h.waitFor("secret "+name+" to have "+key+"="+value, func() bool {
+		s, err := h.kube.CoreV1().Secrets(h.namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false
+		}
+		secret = s
+		return string(s.Data[key]) == value
+	})
+	return secret
+}
+
+// events returns the events with reason recorded for the named object.
+func (h *harness) events(name, reason string) []v1.Event {
+	h.t.Helper()
+
+	list, err := h.kube.CoreV1().Events(h.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	var events []v1.Event
+	for _, e := range list.Items {
+		if e.InvolvedObject.Name == name && e.Reason == reason {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func newTrvsSecret(name string) *travisv1.TrvsSecret {
+	return &travisv1.TrvsSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       travisv1.TrvsSecretSpec{App: "app", Environment: "production"},
+	}
+}
+
+func TestCreatesSecret(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	h := newHarness(t, dir)
+	defer h.stop()
+
+	ts := h.create(newTrvsSecret("app"))
+
+	secret := h.waitForData("app", "DATABASE_URL", "postgres://org-production")
+	if !metav1.IsControlledBy(secret, ts) {
+		t.Errorf("secret is not controlled by its TrvsSecret: %+v", secret.OwnerReferences)
+	}
+	if got := secret.Annotations[trvssecret.KeychainCommitAnnotation]; got != h.org.Head() {
+		t.Errorf("secret was generated from keychain commit %s, want %s", got, h.org.Head())
+	}
+
+	h.waitFor("status to be updated", func() bool {
+		status := h.trvsSecret("app").Status
+		return status.KeychainCommit == h.org.Head() && status.Revision != "" && status.CurrentSecret == "app"
+	})
+	if hasFinalizer(h.trvsSecret("app")) {
+		t.Error("TrvsSecret with the Delete policy got a finalizer")
+	}
+	h.waitFor("a CreateSecret event", func() bool {
+		return len(h.events("app", "CreateSecret")) == 1
+	})
+}
+
+func TestUpdatesSecretWhenSpecChanges(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	h := newHarness(t, dir)
+	defer h.stop()
+
+	h.create(newTrvsSecret("app"))
+	h.waitForData("app", "DATABASE_URL", "postgres://org-production")
+
+	ts := h.trvsSecret("app")
+	ts.Spec.IsPro = true
+	ts.Spec.Prefix = "primary"
+	if _, err := h.travis.TravisciV1().TrvsSecrets(namespace).Update(ts); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := h.waitForData("app", "PRIMARY_DATABASE_URL", "postgres://com-production")
+	if _, ok := secret.Data["DATABASE_URL"]; ok {
+		t.Error("key generated for the old spec was kept")
+	}
+	h.waitFor("status to name the .com keychain commit", func() bool {
+		return h.trvsSecret("app").Status.KeychainCommit == h.com.Head()
+	})
+}
+
+func TestFollowsKeychainChanges(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	h := newHarness(t, dir)
+	defer h.stop()
+
+	h.create(newTrvsSecret("app"))
+	h.waitForData("app", "DATABASE_URL", "postgres://org-production")
+
+	commit := h.org.Commit(map[string]string{
+		"app/production.json": `{"database_url": "postgres://org-production-2", "api_token": "token-123456"}`,
+	})
+
+	secret := h.waitForData("app", "DATABASE_URL", "postgres://org-production-2")
+	if string(secret.Data["API_TOKEN"]) != "token-123456" {
+		t.Errorf("new key API_TOKEN is %q", secret.Data["API_TOKEN"])
+	}
+	if got := secret.Annotations[trvssecret.KeychainCommitAnnotation]; got != commit {
+		t.Errorf("secret was generated from keychain commit %s, want %s", got, commit)
+	}
+	h.waitFor("status to name the new keychain commit", func() bool {
+		return h.trvsSecret("app").Status.KeychainCommit == commit
+	})
+}
+
+func TestDeletesWithDeletePolicy(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	h := newHarness(t, dir)
+	defer h.stop()
+
+	h.create(newTrvsSecret("app"))
+	h.waitForData("app", "DATABASE_URL", "postgres://org-production")
+
+	const value = "postgres://org-production"
+	if h.redactor.Redact(value) == value {
+		t.Fatal("generated value isn't redacted")
+	}
+
+	if err := h.travis.TravisciV1().TrvsSecrets(namespace).Delete("app", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// with no finalizer, it is gone right away and the garbage collector
+	// takes care of the secret
+	if _, err := h.travis.TravisciV1().TrvsSecrets(namespace).Get("app", metav1.GetOptions{}); err == nil {
+		t.Fatal("TrvsSecret is still there after deleting it")
+	}
+	h.waitFor("values of the deleted TrvsSecret to be forgotten", func() bool {
+		return h.redactor.Redact(value) == value
+	})
+}
+
+func TestRetainsSecretWithRetainPolicy(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	h := newHarness(t, dir)
+	defer h.stop()
+
+	ts := newTrvsSecret("app")
+	ts.Spec.DeletionPolicy = travisv1.DeletionPolicyRetain
+	h.create(ts)
+	h.waitForData("app", "DATABASE_URL", "postgres://org-production")
+	h.waitFor("finalizer to be added", func() bool {
+		return hasFinalizer(h.trvsSecret("app"))
+	})
+
+	if err := h.travis.TravisciV1().TrvsSecrets(namespace).Delete("app", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.waitFor("TrvsSecret to be finalized", func() bool {
+		_, err := h.travis.TravisciV1().TrvsSecrets(namespace).Get("app", metav1.GetOptions{})
+		return err != nil
+	})
+
+	secret, err := h.kube.CoreV1().Secrets(namespace).Get("app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("retained secret is gone: %v", err)
+	}
+	if len(secret.OwnerReferences) != 0 {
+		t.Errorf("retained secret still has owners: %+v", secret.OwnerReferences)
+	}
+	if secret.Labels[formerOwnerLabel] != "app" || secret.Labels[managedByLabel] != "" {
+		t.Errorf("retained secret has labels %v", secret.Labels)
+	}
+	if string(secret.Data["DATABASE_URL"]) != "postgres://org-production" {
+		t.Errorf("retained secret lost its data: %v", secret.Data)
+	}
+}
+
+func TestDriftIsReportedOnce(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	h := newHarness(t, dir)
+	defer h.stop()
+
+	ts := newTrvsSecret("app")
+	ts.Spec.DriftPolicy = travisv1.DriftPolicyPause
+	h.create(ts)
+	secret := h.waitForData("app", "DATABASE_URL", "postgres://org-production")
+
+	secret.Data["DATABASE_URL"] = []byte("postgres://edited-by-hand")
+	if _, err := h.kube.CoreV1().Secrets(namespace).Update(secret); err != nil {
+		t.Fatal(err)
+	}
+
+	h.waitFor("the edit to be reported", func() bool {
+		return len(h.events("app", DriftDetected)) > 0
+	})
+
+	// a keychain change syncs it again, without overwriting the edit
+	commit := h.org.Commit(map[string]string{"app/staging.json": `{"database_url": "postgres://org-staging"}`})
+	h.waitFor("the keychain change to be synced", func() bool {
+		return h.trvsSecret("app").Status.KeychainCommit == commit
+	})
+
+	time.Sleep(200 * time.Millisecond)
+	if n := len(h.events("app", DriftDetected)); n != 1 {
+		t.Errorf("the same edit was reported %d times", n)
+	}
+	if h.metrics.DriftDetected.Get(namespace+"/app") == nil {
+		t.Error("drift wasn't counted in the controller's metrics")
+	}
+
+	secret, err := h.kube.CoreV1().Secrets(namespace).Get("app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["DATABASE_URL"]) != "postgres://edited-by-hand" {
+		t.Errorf("paused secret was overwritten with %q", secret.Data["DATABASE_URL"])
+	}
+	drifted := false
+	for _, c := range h.trvsSecret("app").Status.Conditions {
+		drifted = drifted || c.Type == travisv1.TrvsSecretDrifted && c.Status == v1.ConditionTrue
+	}
+	if !drifted {
+		t.Error("TrvsSecret isn't Drifted")
+	}
+}
+
+func TestAuditRecordsUseControllerClock(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	now := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	sink := &recordingSink{}
+	h := newHarness(t, dir, WithClock(clock.NewFakeClock(now)), WithAuditor(&Auditor{Sinks: []AuditSink{sink}}))
+	defer h.stop()
+
+	h.create(newTrvsSecret("app"))
+	h.waitFor("the new secret to be audited", func() bool {
+		return len(sink.all()) > 0
+	})
+
+	if got := sink.all()[0].Time; !got.Equal(now) {
+		t.Errorf("record was made at %s, want the controller's time %s", got, now)
+	}
+}
+
+// recordingNotifier keeps what it is told about syncs.
+type recordingNotifier struct {
+	mu        sync.Mutex
+	outcomes  []string
+	forgotten []string
+}
+
+func (n *recordingNotifier) record(outcomes *[]string, outcome string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	*outcomes = append(*outcomes, outcome)
+}
+
+func (n *recordingNotifier) SyncFailed(namespace, name string, err error) {
+	n.record(&n.outcomes, "failed "+namespace+"/"+name)
+}
+
+func (n *recordingNotifier) SyncSucceeded(namespace, name string) {
+	n.record(&n.outcomes, "succeeded "+namespace+"/"+name)
+}
+
+func (n *recordingNotifier) Forget(namespace, name string) {
+	n.record(&n.forgotten, namespace+"/"+name)
+}
+
+func (n *recordingNotifier) last() (string, int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.outcomes) == 0 {
+		return "", 0
+	}
+	return n.outcomes[len(n.outcomes)-1], len(n.forgotten)
+}
+
+func TestFailedGenerationIsRetriedAndNotified(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	notifier := &recordingNotifier{}
+	h := newHarness(t, dir, WithNotifier(notifier))
+	defer h.stop()
+
+	// there's nothing in the keychain for staging yet
+	ts := newTrvsSecret("app")
+	ts.Spec.Environment = "staging"
+	h.create(ts)
+
+	h.waitFor("the failed sync to be notified", func() bool {
+		last, _ := notifier.last()
+		return last == "failed default/app"
+	})
+
+	// it is retried, and succeeds once the keychain has it
+	h.org.Commit(map[string]string{"app/staging.json": `{"database_url": "postgres://org-staging"}`})
+	h.waitForData("app", "DATABASE_URL", "postgres://org-staging")
+	h.waitFor("the successful sync to be notified", func() bool {
+		last, _ := notifier.last()
+		return last == "succeeded default/app"
+	})
+
+	if err := h.travis.TravisciV1().TrvsSecrets(namespace).Delete("app", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	h.waitFor("the deleted TrvsSecret to be forgotten", func() bool {
+		_, forgotten := notifier.last()
+		return forgotten > 0
+	})
+}
+
+func TestIgnoresSecretsOfMissingTrvsSecrets(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	h := newHarness(t, dir)
+	defer h.stop()
+
+	orphan := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "orphan", Namespace: namespace}}
+	controllerRef := true
+	orphan.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "travisci.com/v1",
+		Kind:       "TrvsSecret",
+		Name:       "missing",
+		UID:        "missing",
+		Controller: &controllerRef,
+	}}
+	if _, err := h.kube.CoreV1().Secrets(namespace).Create(orphan); err != nil {
+		t.Fatal(err)
+	}
+
+	// the controller keeps going
+	h.create(newTrvsSecret("app"))
+	h.waitForData("app", "DATABASE_URL", "postgres://org-production")
+}
+
+func TestRunReportsWorkersLeftRunning(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	block := filepath.Join(dir, "slow")
+	if err := ioutil.WriteFile(block, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SLOW_TRVS", block)
+	defer os.Unsetenv("SLOW_TRVS")
+	// let the abandoned worker finish
+	defer os.Remove(block)
+
+	h := newHarness(t, dir)
+
+	ts := newTrvsSecret("slow")
+	ts.Spec.App = "slow"
+	h.create(ts)
+	h.waitFor("trvs to run", func() bool {
+		return h.trvsMetrics.Running.Value() == 1
+	})
+
+	if err := h.shutdown(); err == nil {
+		t.Fatal("Run returned nil while a worker was still running")
+	}
+}
+
+func TestForbiddenTrvsSecretGetsItsCondition(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	// the admission webhook would reject changes to a forbidden TrvsSecret
+	travis := kubetest.NewTravisClientset()
+	travis.PrependReactor("update", "trvssecrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "" {
+			return false, nil, nil
+		}
+		return true, nil, errors.NewForbidden(travisv1.Resource("trvssecrets"), "app", fmt.Errorf("app is forbidden"))
+	})
+
+	h := startHarness(t, dir, kubetest.NewClientset(), travis, namespace, WithAuthorizer(forbidApp("app")))
+	defer h.stop()
+
+	ts := newTrvsSecret("app")
+	ts.Spec.DeletionPolicy = travisv1.DeletionPolicyRetain
+	h.create(ts)
+
+	h.waitFor("the Forbidden condition", func() bool {
+		for _, c := range h.trvsSecret("app").Status.Conditions {
+			if c.Type == travisv1.TrvsSecretForbidden {
+				return c.Status == v1.ConditionTrue
+			}
+		}
+		return false
+	})
+	if _, err := h.kube.CoreV1().Secrets(namespace).Get("app", metav1.GetOptions{}); err == nil {
+		t.Error("a secret was generated for a forbidden TrvsSecret")
+	}
+}
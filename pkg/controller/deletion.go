@@ -0,0 +1,170 @@
+package controller
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	"github.com/travis-ci/trvs-operator/pkg/trvssecret"
+)
+
+// secretFinalizer keeps a TrvsSecret with the Retain or Orphan deletion policy
+// around until the policy has been applied to its secret.
+const secretFinalizer = "travisci.com/secret-cleanup"
+
+// formerOwnerLabel names the TrvsSecret a retained secret used to belong to.
+const formerOwnerLabel = "travisci.com/former-owner"
+
+const (
+	RetainSecret        = "RetainSecret"
+	MessageRetainSecret = "Retained secret %q after deletion"
+	OrphanSecret        = "OrphanSecret"
+	MessageOrphanSecret = "Orphaned secret %q after deletion"
+)
+
+func hasFinalizer(ts *travisv1.TrvsSecret) bool {
+	for _, f := range ts.Finalizers {
+		if f == secretFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// needsFinalizer reports whether the deletion policy of ts has to be applied
+// by the operator. The default Delete policy doesn't: the garbage collector
+// deletes the secret through its owner reference, even while the operator
+// isn't running.
+func needsFinalizer(ts *travisv1.TrvsSecret) bool {
+	switch ts.Spec.DeletionPolicy {
+	case travisv1.DeletionPolicyRetain, travisv1.DeletionPolicyOrphan:
+		return true
+	default:
+		return false
+	}
+}
+
+// syncFinalizer adds the finalizer to ts if its deletion policy needs it, and
+// removes it if it doesn't, such as after the policy was changed back to
+// Delete.
+func (c *Controller) syncFinalizer(ts *travisv1.TrvsSecret) (*travisv1.TrvsSecret, error) {
+	need := needsFinalizer(ts)
+	if need == hasFinalizer(ts) {
+		return ts, nil
+	}
+
+	ts = ts.DeepCopy()
+	if need {
+		ts.Finalizers = append(ts.Finalizers, secretFinalizer)
+	} else {
+		ts.Finalizers = withoutFinalizer(ts.Finalizers)
+	}
+	return c.travisclient.TravisciV1().TrvsSecrets(ts.Namespace).Update(ts)
+}
+
+func withoutFinalizer(finalizers []string) []string {
+	var kept []string
+	for _, f := range finalizers {
+		if f != secretFinalizer {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// finalize applies the deletion policy of a TrvsSecret that is being deleted
+// and then lets the deletion go ahead.
+func (c *Controller) finalize(ts *travisv1.TrvsSecret) error {
+	if !hasFinalizer(ts) {
+		return nil
+	}
+
+	entry := controllerLog.WithFields(log.Fields{
+		"namespace": ts.Namespace,
+		"name":      ts.Name,
+		"policy":    ts.Spec.DeletionPolicy,
+	})
+
+	switch ts.Spec.DeletionPolicy {
+	case travisv1.DeletionPolicyRetain, travisv1.DeletionPolicyOrphan:
+		name := secretName(ts)
+		if ts.Spec.Immutable && ts.Status.CurrentSecret != "" {
+			name = ts.Status.CurrentSecret
+		}
+
+		if err := c.releaseSecret(ts, name); err != nil {
+			entry.WithError(err).Error("could not release secret")
+			return err
+		}
+	default:
+		// the secret is deleted by the garbage collector through its owner
+		// reference once the TrvsSecret is gone
+	}
+
+	ts = ts.DeepCopy()
+	ts.Finalizers = withoutFinalizer(ts.Finalizers)
+
+	if _, err := c.travisclient.TravisciV1().TrvsSecrets(ts.Namespace).Update(ts); err != nil && !errors.IsNotFound(err) {
+		entry.WithError(err).Error("could not remove finalizer")
+		return err
+	}
+
+	entry.Info("finalized secret")
+	return nil
+}
+
+// releaseSecret detaches the named secret of ts from it, so that it isn't
+// garbage collected or swept once ts is gone.
+func (c *Controller) releaseSecret(ts *travisv1.TrvsSecret, name string) error {
+	secret, err := c.secretsLister.Secrets(ts.Namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !metav1.IsControlledBy(secret, ts) {
+		return nil
+	}
+
+	var refs []metav1.OwnerReference
+	for _, ref := range secret.OwnerReferences {
+		if ref.UID != ts.UID {
+			refs = append(refs, ref)
+		}
+	}
+
+	// nulls remove labels and annotations in a merge patch
+	labels := map[string]interface{}{
+		managedByLabel:            nil,
+		trvssecret.OwnerLabel:     nil,
+		trvssecret.HistoryOfLabel: nil,
+	}
+	metadata := map[string]interface{}{
+		"ownerReferences": refs,
+		"labels":          labels,
+	}
+
+	reason, msg := RetainSecret, MessageRetainSecret
+	if ts.Spec.DeletionPolicy == travisv1.DeletionPolicyRetain {
+		labels[formerOwnerLabel] = ts.Name
+	} else {
+		reason, msg = OrphanSecret, MessageOrphanSecret
+		metadata["annotations"] = map[string]interface{}{
+			trvssecret.KeychainCommitAnnotation: nil,
+			trvssecret.ManagedKeysAnnotation:    nil,
+			trvssecret.DataHashAnnotation:       nil,
+		}
+	}
+
+	if _, err := c.patchSecret(secret, map[string]interface{}{"metadata": metadata}); err != nil {
+		return err
+	}
+
+	c.recorder.Eventf(ts, v1.EventTypeNormal, reason, msg, secret.Name)
+	return nil
+}
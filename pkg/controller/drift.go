@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	"github.com/travis-ci/trvs-operator/pkg/trvssecret"
+)
+
+const (
+	DriftDetected        = "DriftDetected"
+	MessageDriftDetected = "Secret %q was edited outside of the operator, changed keys: %s"
+)
+
+// driftedKeys returns the keys of a secret that were changed by someone other
+// than the operator since it last wrote the secret, or nil if there weren't
+// any such changes.
+func driftedKeys(secret, desired *v1.Secret) []string {
+	written := secret.Annotations[trvssecret.DataHashAnnotation]
+	if written == "" || written == trvssecret.DataHash(secret.Data) {
+		return nil
+	}
+
+	var keys []string
+	for k, v := range secret.Data {
+		if d, ok := desired.Data[k]; !ok || !bytes.Equal(d, v) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range desired.Data {
+		if _, ok := secret.Data[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// drift describes edits made to a secret outside of the operator.
+type drift struct {
+	secret string
+	keys   []string
+
+	// hash is the hash of the edited data
+	hash string
+}
+
+// checkDrift reports keys of the secret of ts that were edited by hand. An
+// edit is only reported the first time it is seen, so a secret left edited
+// under the Pause policy doesn't report it again with every sync. The returned
+// drift is to be saved in the status of ts with setDriftCondition.
+func (c *Controller) checkDrift(ts *travisv1.TrvsSecret, secret, desired *v1.Secret) drift {
+	keys := driftedKeys(secret, desired)
+	if len(keys) == 0 {
+		return drift{}
+	}
+
+	d := drift{
+		secret: secret.Name,
+		keys:   keys,
+		hash:   trvssecret.DataHash(secret.Data),
+	}
+	if d.hash == ts.Status.DriftedDataHash {
+		return d
+	}
+
+	controllerLog.WithFields(log.Fields{
+		"namespace": secret.Namespace,
+		"name":      secret.Name,
+		"keys":      keys,
+		"policy":    ts.Spec.DriftPolicy,
+	}).Warn("secret was edited outside of the operator")
+
+	c.metrics.DriftDetected.Add(ts.Namespace+"/"+ts.Name, 1)
+	c.recorder.Eventf(ts, v1.EventTypeWarning, DriftDetected, MessageDriftDetected, secret.Name, strings.Join(keys, ", "))
+
+	return d
+}
+
+// setDriftCondition records in status whether the secret holds edits made
+// outside of the operator.
+func setDriftCondition(status *travisv1.TrvsSecretStatus, now time.Time, d drift) {
+	status.DriftedDataHash = d.hash
+
+	if d.hash == "" {
+		// only TrvsSecrets that ever drifted have the condition
+		if hasCondition(status, travisv1.TrvsSecretDrifted) {
+			setCondition(status, now, travisv1.TrvsSecretDrifted, v1.ConditionFalse, "NoEdits", "")
+		}
+		return
+	}
+
+	setCondition(status, now, travisv1.TrvsSecretDrifted, v1.ConditionTrue, DriftDetected,
+		fmt.Sprintf(MessageDriftDetected, d.secret, strings.Join(d.keys, ", ")))
+}
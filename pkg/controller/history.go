@@ -0,0 +1,175 @@
+package controller
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	"github.com/travis-ci/trvs-operator/pkg/trvssecret"
+)
+
+const (
+	RollbackSecret        = "RollbackSecret"
+	MessageRollbackSecret = "Rolled back secret %q to revision %s"
+	ErrRevisionNotFound   = "ErrRevisionNotFound"
+)
+
+// newRevisionSecret builds the secret that keeps a revision of the generated
+// data of ts. It is never changed once created.
+func newRevisionSecret(ts *travisv1.TrvsSecret, generated map[string][]byte, commit string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      trvssecret.RevisionSecretName(ts, trvssecret.Revision(generated)),
+			Namespace: ts.Namespace,
+			Labels: map[string]string{
+				trvssecret.HistoryOfLabel: ts.Name,
+			},
+			Annotations: map[string]string{
+				trvssecret.KeychainCommitAnnotation: commit,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(ts, schema.GroupVersionKind{
+					Group:   travisv1.SchemeGroupVersion.Group,
+					Version: travisv1.SchemeGroupVersion.Version,
+					Kind:    "TrvsSecret",
+				}),
+			},
+		},
+		Data: generated,
+	}
+}
+
+// createRevisionSecret creates the secret that keeps a revision of the
+// generated data of ts and marks it immutable.
+func (c *Controller) createRevisionSecret(ts *travisv1.TrvsSecret, generated map[string][]byte, commit string) (*v1.Secret, error) {
+	secret, err := c.kubeclient.CoreV1().Secrets(ts.Namespace).Create(newRevisionSecret(ts, generated, commit))
+	if err != nil {
+		return nil, err
+	}
+
+	// the vendored API types predate the immutable field of secrets, added in
+	// Kubernetes 1.19, so it's set with a patch; older API servers drop it. The
+	// operator never changes the data of a revision anyway, so failing to set
+	// it isn't worth retrying over.
+	if _, err := c.patchSecret(secret, map[string]interface{}{"immutable": true}); err != nil {
+		controllerLog.WithError(err).WithFields(log.Fields{
+			"namespace": secret.Namespace,
+			"name":      secret.Name,
+		}).Warn("could not make secret immutable")
+	}
+
+	return secret, nil
+}
+
+// recordRevision keeps the generated data of ts in its history, if it isn't
+// there yet, and prunes revisions beyond the history limit.
+func (c *Controller) recordRevision(ts *travisv1.TrvsSecret, generated map[string][]byte, commit string) error {
+	if ts.Spec.HistoryLimit <= 0 {
+		return nil
+	}
+
+	rev := trvssecret.Revision(generated)
+	entry := controllerLog.WithFields(log.Fields{
+		"namespace": ts.Namespace,
+		"name":      ts.Name,
+		"revision":  rev,
+	})
+
+	existing, err := c.secretsLister.Secrets(ts.Namespace).Get(trvssecret.RevisionSecretName(ts, rev))
+	switch {
+	case errors.IsNotFound(err):
+		if _, err := c.createRevisionSecret(ts, generated, commit); err != nil && !errors.IsAlreadyExists(err) {
+			entry.WithError(err).Error("could not record revision")
+			return err
+		}
+		entry.Info("recorded revision")
+	case err != nil:
+		return err
+	case !metav1.IsControlledBy(existing, ts):
+		entry.Warn("a secret with the name of the revision exists and isn't ours")
+		return nil
+	}
+
+	return c.pruneHistory(ts, rev)
+}
+
+// history returns the revision secrets of ts, newest first.
+func (c *Controller) history(ts *travisv1.TrvsSecret) ([]*v1.Secret, error) {
+	selector := labels.SelectorFromSet(labels.Set{trvssecret.HistoryOfLabel: ts.Name})
+	secrets, err := c.secretsLister.Secrets(ts.Namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var owned []*v1.Secret
+	for _, s := range secrets {
+		if metav1.IsControlledBy(s, ts) {
+			owned = append(owned, s)
+		}
+	}
+
+	sort.Slice(owned, func(i, j int) bool {
+		return owned[j].CreationTimestamp.Before(&owned[i].CreationTimestamp)
+	})
+	return owned, nil
+}
+
+// pruneHistory deletes the oldest revisions of ts beyond its history limit.
+// The current revision and a pinned one are kept even if they are older.
+func (c *Controller) pruneHistory(ts *travisv1.TrvsSecret, current string) error {
+	secrets, err := c.history(ts)
+	if err != nil {
+		return err
+	}
+
+	keep := map[string]bool{
+		trvssecret.RevisionSecretName(ts, current): true,
+	}
+	if ts.Spec.RollbackTo != "" {
+		keep[trvssecret.RevisionSecretName(ts, ts.Spec.RollbackTo)] = true
+	}
+
+	for i, s := range secrets {
+		if i < int(ts.Spec.HistoryLimit) || keep[s.Name] {
+			continue
+		}
+
+		uid := s.UID
+		err := c.kubeclient.CoreV1().Secrets(s.Namespace).Delete(s.Name, &metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &uid},
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+
+		controllerLog.WithFields(log.Fields{
+			"namespace": s.Namespace,
+			"name":      s.Name,
+		}).Info("pruned revision")
+	}
+
+	return nil
+}
+
+// rollback returns the data and keychain commit of a revision of ts.
+func (c *Controller) rollback(ts *travisv1.TrvsSecret, rev string) (map[string][]byte, string, error) {
+	secret, err := c.secretsLister.Secrets(ts.Namespace).Get(trvssecret.RevisionSecretName(ts, rev))
+	if err == nil && !metav1.IsControlledBy(secret, ts) {
+		err = errors.NewNotFound(v1.Resource("secrets"), secret.Name)
+	}
+	if err != nil {
+		if errors.IsNotFound(err) {
+			c.recorder.Eventf(ts, v1.EventTypeWarning, ErrRevisionNotFound, "Revision %s of secret %q does not exist", rev, secretName(ts))
+		}
+		return nil, "", fmt.Errorf("could not get revision %s: %v", rev, err)
+	}
+
+	return secret.Data, secret.Annotations[trvssecret.KeychainCommitAnnotation], nil
+}
@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	"github.com/travis-ci/trvs-operator/pkg/trvssecret"
+)
+
+// defaultRetention is how long superseded immutable secrets are kept when the
+// TrvsSecret doesn't say.
+const defaultRetention = 24 * time.Hour
+
+// currentSecretName is the name of the secret that holds the current data of
+// ts.
+func currentSecretName(ts *travisv1.TrvsSecret, generated map[string][]byte) string {
+	if ts.Spec.Immutable {
+		return trvssecret.RevisionSecretName(ts, trvssecret.Revision(generated))
+	}
+	return secretName(ts)
+}
+
+// syncImmutableSecret makes sure the revision secret for the generated data
+// exists, points workloads at it if it's new and prunes expired revisions. It
+// reports whether the current secret changed.
+func (c *Controller) syncImmutableSecret(ts *travisv1.TrvsSecret, entry *log.Entry, generated map[string][]byte, commit string, rewrite bool) (bool, error) {
+	name := currentSecretName(ts, generated)
+	entry = entry.WithField("secret", name)
+
+	secret, err := c.secretsLister.Secrets(ts.Namespace).Get(name)
+	if errors.IsNotFound(err) {
+		secret, err = c.createRevisionSecret(ts, generated, commit)
+		if err == nil {
+			c.recorder.Eventf(ts, v1.EventTypeNormal, "CreateSecret", "Created secret: %s", secret.Name)
+		}
+	}
+
+	if err != nil {
+		entry.WithError(err).Error("could not find/create secret")
+		return false, err
+	}
+
+	// the current secret and the workloads stay as they are, rather than
+	// pointing them at a secret someone else controls
+	if !metav1.IsControlledBy(secret, ts) {
+		c.recorder.Eventf(ts, v1.EventTypeWarning, ErrResourceExists, MessageResourceExists, secret.Name)
+		return false, fmt.Errorf(MessageResourceExists, secret.Name)
+	}
+
+	changed := ts.Status.CurrentSecret != name
+	if changed {
+		c.auditImmutable(ts, secret, commit)
+	}
+
+	if changed || rewrite {
+		if err := c.updateWorkloads(ts, name); err != nil {
+			entry.WithError(err).Error("could not update workloads")
+			return changed, err
+		}
+	}
+
+	return changed, c.pruneExpired(ts, name)
+}
+
+// auditImmutable records a switch to a new current secret, comparing it to
+// the previous one.
+func (c *Controller) auditImmutable(ts *travisv1.TrvsSecret, current *v1.Secret, commit string) {
+	action := AuditUpdate
+	switch {
+	case ts.Spec.RollbackTo != "":
+		action = AuditRollback
+	case ts.Status.CurrentSecret == "":
+		action = AuditCreate
+	}
+
+	var old map[string][]byte
+	if ts.Status.CurrentSecret != "" {
+		if previous, err := c.secretsLister.Secrets(ts.Namespace).Get(ts.Status.CurrentSecret); err == nil {
+			old = previous.Data
+		}
+	}
+
+	c.audit.Record(action, ts, current.Name, commit, old, current.Data)
+}
+
+// pruneExpired deletes immutable secrets of ts that were superseded longer
+// than its retention period ago. The newest revisions up to the history limit,
+// the current one and a pinned one are always kept.
+func (c *Controller) pruneExpired(ts *travisv1.TrvsSecret, current string) error {
+	retention := ts.Spec.Retention.Duration
+	if retention == 0 {
+		retention = defaultRetention
+	}
+
+	secrets, err := c.history(ts)
+	if err != nil {
+		return err
+	}
+
+	keep := map[string]bool{
+		current: true,
+	}
+	if ts.Spec.RollbackTo != "" {
+		keep[trvssecret.RevisionSecretName(ts, ts.Spec.RollbackTo)] = true
+	}
+
+	for i, s := range secrets {
+		if i == 0 || i < int(ts.Spec.HistoryLimit) || keep[s.Name] {
+			continue
+		}
+
+		// a revision is superseded when the next one is created
+		if c.clock.Since(secrets[i-1].CreationTimestamp.Time) < retention {
+			continue
+		}
+
+		uid := s.UID
+		err := c.kubeclient.CoreV1().Secrets(s.Namespace).Delete(s.Name, &metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &uid},
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+
+		controllerLog.WithFields(log.Fields{
+			"namespace": s.Namespace,
+			"name":      s.Name,
+		}).Info("pruned expired secret")
+	}
+
+	return nil
+}
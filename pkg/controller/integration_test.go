@@ -0,0 +1,474 @@
+package controller
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/travis-ci/trvs-operator/internal/envtest"
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	travisclientset "github.com/travis-ci/trvs-operator/pkg/client/clientset/versioned"
+	travisinformers "github.com/travis-ci/trvs-operator/pkg/client/informers/externalversions"
+	"github.com/travis-ci/trvs-operator/pkg/trvssecret"
+)
+
+// The TestEnv tests run the controller against a local API server, with the
+// garbage collector running, instead of fake clientsets. They are skipped
+// unless the binaries internal/envtest needs are installed.
+
+// envNamespaceLabel carries the name of a namespace created for a test, so
+// webhooks can be limited to it.
+const envNamespaceLabel = "travisci.com/envtest"
+
+var (
+	envOnce sync.Once
+	env     *envtest.Environment
+	envErr  error
+
+	envNamespaces int32
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if env != nil {
+		if err := env.Stop(); err != nil {
+			fmt.Fprintf(os.Stderr, "could not stop the control plane: %v\n", err)
+		}
+	}
+	os.Exit(code)
+}
+
+// startEnv returns the control plane shared by the tests, starting it the
+// first time.
+func startEnv(t *testing.T) *envtest.Environment {
+	t.Helper()
+
+	if !envtest.Installed() {
+		t.Skip("the control plane binaries aren't installed, see internal/envtest")
+	}
+
+	envOnce.Do(func() {
+		env, envErr = envtest.Start(filepath.Join("..", "..", "chart", "trvs-operator", "templates", "crd.yaml"))
+	})
+	if envErr != nil {
+		t.Fatalf("could not start the control plane: %v", envErr)
+	}
+	return env
+}
+
+// newEnvHarness runs a Controller against the local API server, in a
+// namespace of its own.
+func newEnvHarness(t *testing.T, dir string, opts ...Option) *harness {
+	t.Helper()
+
+	e := startEnv(t)
+	kube := kubernetes.NewForConfigOrDie(e.Config)
+	travis := travisclientset.NewForConfigOrDie(e.Config)
+
+	// numbered, as with -count the same test runs more than once
+	name := fmt.Sprintf("envtest-%d-%s", atomic.AddInt32(&envNamespaces, 1), strings.ToLower(strings.TrimPrefix(t.Name(), "TestEnv")))
+	ns, err := kube.CoreV1().Namespaces().Create(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{envNamespaceLabel: name}},
+	})
+	if err != nil {
+		t.Fatalf("could not create namespace: %v", err)
+	}
+
+	return startHarness(t, dir, kube, travis, ns.Name, opts...)
+}
+
+func (h *harness) secretGone(name string) bool {
+	_, err := h.kube.CoreV1().Secrets(h.namespace).Get(name, metav1.GetOptions{})
+	return errors.IsNotFound(err)
+}
+
+func TestEnvCreatesUpdatesAndDeletes(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	h := newEnvHarness(t, dir)
+	defer h.stop()
+
+	ts := newTrvsSecret("app")
+	ts.Spec.HistoryLimit = 2
+	ts = h.create(ts)
+
+	secret := h.waitForData("app", "DATABASE_URL", "postgres://org-production")
+	if !metav1.IsControlledBy(secret, ts) {
+		t.Errorf("secret is not controlled by its TrvsSecret: %+v", secret.OwnerReferences)
+	}
+	h.waitFor("status to be updated", func() bool {
+		ts := h.trvsSecret("app")
+		return ts.Status.KeychainCommit == h.org.Head() && ts.Status.Revision != "" && ts.Status.ObservedGeneration == ts.Generation
+	})
+
+	// status is a subresource: writing it doesn't bump the generation, and
+	// writing the TrvsSecret doesn't change it
+	ts = h.trvsSecret("app")
+	if ts.Generation != 1 {
+		t.Errorf("generation is %d after status updates, want 1", ts.Generation)
+	}
+	revision := ts.Status.Revision
+	ts.Spec.IsPro = true
+	ts.Spec.Prefix = "primary"
+	ts.Status.Revision = "bogus"
+	updated, err := h.travis.TravisciV1().TrvsSecrets(h.namespace).Update(ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Status.Revision != revision || updated.Generation != 2 {
+		t.Errorf("update left revision %q and generation %d, want %q and 2", updated.Status.Revision, updated.Generation, revision)
+	}
+
+	secret = h.waitForData("app", "PRIMARY_DATABASE_URL", "postgres://com-production")
+	if _, ok := secret.Data["DATABASE_URL"]; ok {
+		t.Error("the merge patch kept the key generated for the old spec")
+	}
+	h.waitFor("status to catch up with the new generation", func() bool {
+		ts := h.trvsSecret("app")
+		return ts.Status.ObservedGeneration == 2 && ts.Status.KeychainCommit == h.com.Head()
+	})
+
+	history := labels.SelectorFromSet(labels.Set{trvssecret.HistoryOfLabel: "app"}).String()
+	revisions, err := h.kube.CoreV1().Secrets(h.namespace).List(metav1.ListOptions{LabelSelector: history})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions.Items) != 2 {
+		t.Fatalf("got %d revision secrets, want 2", len(revisions.Items))
+	}
+
+	if err := h.travis.TravisciV1().TrvsSecrets(h.namespace).Delete("app", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the garbage collector deletes everything the TrvsSecret owned
+	h.waitFor("the garbage collector to delete the secrets", func() bool {
+		list, err := h.kube.CoreV1().Secrets(h.namespace).List(metav1.ListOptions{LabelSelector: history})
+		return err == nil && len(list.Items) == 0 && h.secretGone("app")
+	})
+}
+
+func TestEnvRetainsSecretThroughFinalizer(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	h := newEnvHarness(t, dir)
+	defer h.stop()
+
+	ts := newTrvsSecret("app")
+	ts.Spec.DeletionPolicy = travisv1.DeletionPolicyRetain
+	h.create(ts)
+	h.waitForData("app", "DATABASE_URL", "postgres://org-production")
+	h.waitFor("finalizer to be added", func() bool {
+		return hasFinalizer(h.trvsSecret("app"))
+	})
+
+	if err := h.travis.TravisciV1().TrvsSecrets(h.namespace).Delete("app", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.waitFor("TrvsSecret to be finalized", func() bool {
+		_, err := h.travis.TravisciV1().TrvsSecrets(h.namespace).Get("app", metav1.GetOptions{})
+		return errors.IsNotFound(err)
+	})
+
+	secret, err := h.kube.CoreV1().Secrets(h.namespace).Get("app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("retained secret is gone: %v", err)
+	}
+	if len(secret.OwnerReferences) != 0 {
+		t.Errorf("retained secret still has owners the garbage collector would follow: %+v", secret.OwnerReferences)
+	}
+	if secret.Labels[formerOwnerLabel] != "app" {
+		t.Errorf("retained secret has labels %v", secret.Labels)
+	}
+}
+
+func TestEnvAdoptsSecretKeepingOthersMetadata(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	h := newEnvHarness(t, dir)
+	defer h.stop()
+
+	owner, err := h.kube.CoreV1().ConfigMaps(h.namespace).Create(&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "owner"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownerRef := metav1.OwnerReference{APIVersion: "v1", Kind: "ConfigMap", Name: owner.Name, UID: owner.UID}
+
+	if _, err := h.kube.CoreV1().Secrets(h.namespace).Create(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "app",
+			Labels:          map[string]string{"team": "payments"},
+			Annotations:     map[string]string{"note": "made by hand"},
+			OwnerReferences: []metav1.OwnerReference{ownerRef},
+		},
+		Data: map[string][]byte{"LEGACY_KEY": []byte("legacy")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTrvsSecret("app")
+	ts.Spec.AdoptionPolicy = travisv1.AdoptionPolicyMerge
+	ts = h.create(ts)
+
+	secret := h.waitForData("app", "DATABASE_URL", "postgres://org-production")
+	if string(secret.Data["LEGACY_KEY"]) != "legacy" {
+		t.Errorf("merge adoption dropped LEGACY_KEY: %v", secret.Data)
+	}
+	if secret.Labels["team"] != "payments" || secret.Annotations["note"] != "made by hand" {
+		t.Errorf("adoption dropped labels %v or annotations %v", secret.Labels, secret.Annotations)
+	}
+	if !metav1.IsControlledBy(secret, ts) || len(secret.OwnerReferences) != 2 {
+		t.Errorf("adopted secret has owners %+v, want the ConfigMap and its TrvsSecret", secret.OwnerReferences)
+	}
+
+	backup, err := h.kube.CoreV1().Secrets(h.namespace).Get(backupSecretName("app"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("no backup of the adopted secret: %v", err)
+	}
+	if string(backup.Data["LEGACY_KEY"]) != "legacy" {
+		t.Errorf("backup has data %v", backup.Data)
+	}
+
+	// edits are healed with a merge patch, which leaves what others added
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		s, err := h.kube.CoreV1().Secrets(h.namespace).Get("app", metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		s.Labels["owner"] = "someone"
+		s.Data["DATABASE_URL"] = []byte("postgres://edited")
+		_, err = h.kube.CoreV1().Secrets(h.namespace).Update(s)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret = h.waitForData("app", "DATABASE_URL", "postgres://org-production")
+	if secret.Labels["owner"] != "someone" {
+		t.Errorf("healing dropped a label added by someone else: %v", secret.Labels)
+	}
+}
+
+func TestEnvFollowsKeychainPush(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	h := newEnvHarness(t, dir)
+	defer h.stop()
+
+	h.create(newTrvsSecret("app"))
+	h.waitForData("app", "DATABASE_URL", "postgres://org-production")
+
+	commit := h.org.Commit(map[string]string{
+		"app/production.json": `{"database_url": "postgres://org-production-2"}`,
+	})
+
+	secret := h.waitForData("app", "DATABASE_URL", "postgres://org-production-2")
+	if got := secret.Annotations[trvssecret.KeychainCommitAnnotation]; got != commit {
+		t.Errorf("secret was generated from keychain commit %s, want %s", got, commit)
+	}
+	h.waitFor("status to name the pushed commit", func() bool {
+		return h.trvsSecret("app").Status.KeychainCommit == commit
+	})
+}
+
+func TestEnvConcurrentWritesAreKept(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	h := newEnvHarness(t, dir)
+	defer h.stop()
+
+	ts := newTrvsSecret("app")
+	ts.Spec.DeletionPolicy = travisv1.DeletionPolicyRetain
+	h.create(ts)
+
+	// the controller adds its finalizer and status while these are written;
+	// whichever write is based on an old resource version has to fail and be
+	// retried rather than undo the other
+	const writes = 20
+	for i := 0; i < writes; i++ {
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			ts := h.trvsSecret("app")
+			if ts.Labels == nil {
+				ts.Labels = make(map[string]string)
+			}
+			ts.Labels[fmt.Sprintf("write-%d", i)] = "done"
+			_, err := h.travis.TravisciV1().TrvsSecrets(h.namespace).Update(ts)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h.waitForData("app", "DATABASE_URL", "postgres://org-production")
+	h.waitFor("finalizer and status", func() bool {
+		ts := h.trvsSecret("app")
+		return hasFinalizer(ts) && ts.Status.Revision != ""
+	})
+
+	ts = h.trvsSecret("app")
+	for i := 0; i < writes; i++ {
+		if ts.Labels[fmt.Sprintf("write-%d", i)] != "done" {
+			t.Errorf("write %d was lost: %v", i, ts.Labels)
+		}
+	}
+}
+
+func TestEnvAdmission(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	e := startEnv(t)
+	kube := kubernetes.NewForConfigOrDie(e.Config)
+	travis := travisclientset.NewForConfigOrDie(e.Config)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	kf := kubeinformers.NewSharedInformerFactory(kube, 0)
+	tf := travisinformers.NewSharedInformerFactory(travis, 0)
+	authorizer := NewPolicyAuthorizer(tf.Travisci().V1().TrvsSecretPolicies(), kf.Core().V1().Namespaces(), false)
+
+	h := newEnvHarness(t, dir, WithAuthorizer(authorizer))
+	defer h.stop()
+
+	// only now that New has registered the types it uses
+	kf.Start(stop)
+	tf.Start(stop)
+
+	policies := travis.TravisciV1().TrvsSecretPolicies()
+	policy, err := policies.Create(&travisv1.TrvsSecretPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: h.namespace},
+		Spec:       travisv1.TrvsSecretPolicySpec{Namespaces: []string{h.namespace}, Apps: []string{"app"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer policies.Delete(policy.Name, &metav1.DeleteOptions{})
+
+	h.waitFor("the policy to be loaded", func() bool {
+		reason, _ := authorizer.Authorize(h.namespace, travisv1.TrvsSecretSpec{App: "other"})
+		return reason != ""
+	})
+
+	server := httptest.NewTLSServer(&webhookHandler{policies: authorizer})
+	defer server.Close()
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	const webhooks = "/apis/admissionregistration.k8s.io/v1/validatingwebhookconfigurations"
+	if err := e.Create(webhooks, map[string]interface{}{
+		"apiVersion": "admissionregistration.k8s.io/v1",
+		"kind":       "ValidatingWebhookConfiguration",
+		"metadata":   map[string]interface{}{"name": h.namespace},
+		"webhooks": []interface{}{map[string]interface{}{
+			"name": "trvssecrets.travisci.com",
+			"clientConfig": map[string]interface{}{
+				"url":      server.URL + "/validate-trvssecret",
+				"caBundle": base64.StdEncoding.EncodeToString(caBundle),
+			},
+			"rules": []interface{}{map[string]interface{}{
+				"apiGroups":   []string{"travisci.com"},
+				"apiVersions": []string{"v1"},
+				"operations":  []string{"CREATE", "UPDATE"},
+				"resources":   []string{"trvssecrets"},
+			}},
+			"namespaceSelector": map[string]interface{}{
+				"matchLabels": map[string]string{envNamespaceLabel: h.namespace},
+			},
+			"failurePolicy":           "Fail",
+			"sideEffects":             "None",
+			"admissionReviewVersions": []string{"v1beta1"},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Delete(webhooks + "/" + h.namespace)
+
+	// the API server picks up webhooks in the background
+	h.waitFor("the webhook to reject TrvsSecrets no policy allows", func() bool {
+		ts := newTrvsSecret("other")
+		ts.Spec.App = "other"
+		_, err := h.travis.TravisciV1().TrvsSecrets(h.namespace).Create(ts)
+		if err == nil {
+			h.travis.TravisciV1().TrvsSecrets(h.namespace).Delete("other", &metav1.DeleteOptions{})
+		}
+		return errors.IsForbidden(err)
+	})
+
+	ts := newTrvsSecret("app")
+	ts.Spec.DeletionPolicy = travisv1.DeletionPolicyRetain
+	h.create(ts)
+	h.waitForData("app", "DATABASE_URL", "postgres://org-production")
+	h.waitFor("finalizer to be added", func() bool {
+		return hasFinalizer(h.trvsSecret("app"))
+	})
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		policy, err := policies.Get(policy.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		policy.Spec.Apps = []string{"web"}
+		_, err = policies.Update(policy)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.waitFor("the policy change to be loaded", func() bool {
+		reason, _ := authorizer.Authorize(h.namespace, travisv1.TrvsSecretSpec{App: "app"})
+		return reason != ""
+	})
+
+	// updates that don't change what is requested are still admitted, and
+	// get the TrvsSecret checked again, but not ones that request something
+	// else
+	update := func(change func(ts *travisv1.TrvsSecret)) error {
+		return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			ts := h.trvsSecret("app")
+			change(ts)
+			_, err := h.travis.TravisciV1().TrvsSecrets(h.namespace).Update(ts)
+			return err
+		})
+	}
+	if err := update(func(ts *travisv1.TrvsSecret) { ts.Annotations = map[string]string{"note": "still allowed"} }); err != nil {
+		t.Fatalf("metadata update of a forbidden TrvsSecret was rejected: %v", err)
+	}
+	if err := update(func(ts *travisv1.TrvsSecret) { ts.Spec.Environment = "staging" }); !errors.IsForbidden(err) {
+		t.Fatalf("changing the request of a forbidden TrvsSecret returned %v, want it forbidden", err)
+	}
+
+	h.waitFor("the Forbidden condition", func() bool {
+		for _, c := range h.trvsSecret("app").Status.Conditions {
+			if c.Type == travisv1.TrvsSecretForbidden {
+				return c.Status == v1.ConditionTrue
+			}
+		}
+		return false
+	})
+
+	// so the finalizer can be removed
+	if err := h.travis.TravisciV1().TrvsSecrets(h.namespace).Delete("app", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	h.waitFor("TrvsSecret to be finalized", func() bool {
+		_, err := h.travis.TravisciV1().TrvsSecrets(h.namespace).Get("app", metav1.GetOptions{})
+		return errors.IsNotFound(err)
+	})
+}
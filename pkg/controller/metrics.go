@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"expvar"
+	"sync"
+)
+
+// Metrics counts what a Controller does.
+type Metrics struct {
+	// DriftDetected counts how often drift was found, per TrvsSecret.
+	DriftDetected expvar.Map
+}
+
+var (
+	defaultMetrics Metrics
+	publishOnce    sync.Once
+)
+
+// DefaultMetrics returns the metrics published with expvar as
+// trvs_drift_detected. They are published the first time they are asked for,
+// and shared by every Controller using them.
+func DefaultMetrics() *Metrics {
+	publishOnce.Do(func() {
+		expvar.Publish("trvs_drift_detected", &defaultMetrics.DriftDetected)
+	})
+	return &defaultMetrics
+}
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	listers "github.com/travis-ci/trvs-operator/pkg/client/listers/travisci/v1"
+)
+
+// When only some namespaces are watched, there is an informer for each of
+// them. These listers combine their caches so the controller doesn't need to
+// care how many there are.
+
+type multiSecretLister []corelisters.SecretLister
+
+func (l multiSecretLister) List(selector labels.Selector) ([]*v1.Secret, error) {
+	var ret []*v1.Secret
+	for _, lister := range l {
+		secrets, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, secrets...)
+	}
+	return ret, nil
+}
+
+func (l multiSecretLister) Secrets(namespace string) corelisters.SecretNamespaceLister {
+	return multiSecretNamespaceLister{listers: l, namespace: namespace}
+}
+
+type multiSecretNamespaceLister struct {
+	listers   multiSecretLister
+	namespace string
+}
+
+func (l multiSecretNamespaceLister) List(selector labels.Selector) ([]*v1.Secret, error) {
+	var ret []*v1.Secret
+	for _, lister := range l.listers {
+		secrets, err := lister.Secrets(l.namespace).List(selector)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, secrets...)
+	}
+	return ret, nil
+}
+
+func (l multiSecretNamespaceLister) Get(name string) (*v1.Secret, error) {
+	for _, lister := range l.listers {
+		secret, err := lister.Secrets(l.namespace).Get(name)
+		if !errors.IsNotFound(err) {
+			return secret, err
+		}
+	}
+	return nil, errors.NewNotFound(v1.Resource("secret"), name)
+}
+
+type multiTrvsSecretLister []listers.TrvsSecretLister
+
+func (l multiTrvsSecretLister) List(selector labels.Selector) ([]*travisv1.TrvsSecret, error) {
+	var ret []*travisv1.TrvsSecret
+	for _, lister := range l {
+		secrets, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, secrets...)
+	}
+	return ret, nil
+}
+
+func (l multiTrvsSecretLister) TrvsSecrets(namespace string) listers.TrvsSecretNamespaceLister {
+	return multiTrvsSecretNamespaceLister{listers: l, namespace: namespace}
+}
+
+type multiTrvsSecretNamespaceLister struct {
+	listers   multiTrvsSecretLister
+	namespace string
+}
+
+func (l multiTrvsSecretNamespaceLister) List(selector labels.Selector) ([]*travisv1.TrvsSecret, error) {
+	var ret []*travisv1.TrvsSecret
+	for _, lister := range l.listers {
+		secrets, err := lister.TrvsSecrets(l.namespace).List(selector)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, secrets...)
+	}
+	return ret, nil
+}
+
+func (l multiTrvsSecretNamespaceLister) Get(name string) (*travisv1.TrvsSecret, error) {
+	for _, lister := range l.listers {
+		ts, err := lister.TrvsSecrets(l.namespace).Get(name)
+		if !errors.IsNotFound(err) {
+			return ts, err
+		}
+	}
+	return nil, errors.NewNotFound(travisv1.Resource("trvssecret"), name)
+}
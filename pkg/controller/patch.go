@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// secretPatch builds a JSON merge patch that brings secret in line with
+// desired for the fields the operator owns: the data, the labels and
+// annotations it sets, and its owner reference. Labels, annotations and owner
+// references added by anyone else are left alone.
+//
+// An empty patch means the secret is already up-to-date.
+func secretPatch(secret, desired *v1.Secret) map[string]interface{} {
+	metadata := make(map[string]interface{})
+
+	if labels := changedStrings(secret.Labels, desired.Labels); len(labels) > 0 {
+		metadata["labels"] = labels
+	}
+
+	if annotations := changedStrings(secret.Annotations, desired.Annotations); len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+
+	if refs, changed := ownerReferences(secret, desired); changed {
+		metadata["ownerReferences"] = refs
+	}
+
+	data := make(map[string]interface{})
+	for k, v := range desired.Data {
+		if existing, ok := secret.Data[k]; !ok || !bytes.Equal(existing, v) {
+			data[k] = v
+		}
+	}
+	for k := range secret.Data {
+		if _, ok := desired.Data[k]; !ok {
+			// null removes the key
+			data[k] = nil
+		}
+	}
+
+	patch := make(map[string]interface{})
+	if len(metadata) > 0 {
+		patch["metadata"] = metadata
+	}
+	if len(data) > 0 {
+		patch["data"] = data
+	}
+
+	return patch
+}
+
+func changedStrings(existing, desired map[string]string) map[string]interface{} {
+	changed := make(map[string]interface{})
+	for k, v := range desired {
+		if current, ok := existing[k]; !ok || current != v {
+			changed[k] = v
+		}
+	}
+	return changed
+}
+
+// ownerReferences returns the owner references the secret should have: its
+// existing ones plus the desired controller reference. Merge patches replace
+// lists wholesale, so the complete list is needed.
+func ownerReferences(secret, desired *v1.Secret) ([]metav1.OwnerReference, bool) {
+	controller := metav1.GetControllerOf(desired)
+	if controller == nil {
+		return secret.OwnerReferences, false
+	}
+
+	refs := []metav1.OwnerReference{*controller}
+	changed := true
+	for _, ref := range secret.OwnerReferences {
+		if ref.UID == controller.UID {
+			changed = ref.Controller == nil || !*ref.Controller
+			continue
+		}
+		refs = append(refs, ref)
+	}
+
+	return refs, changed
+}
+
+// patchSecret applies a merge patch to a secret. The patch is made conditional
+// on the secret's resource version, so it fails with a conflict if someone
+// else changed the secret since it was read, rather than silently overwriting
+// their changes.
+func (c *Controller) patchSecret(secret *v1.Secret, patch map[string]interface{}) (*v1.Secret, error) {
+	metadata, ok := patch["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = make(map[string]interface{})
+		patch["metadata"] = metadata
+	}
+	metadata["resourceVersion"] = secret.ResourceVersion
+
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	patched, err := c.kubeclient.CoreV1().Secrets(secret.Namespace).Patch(secret.Name, types.MergePatchType, body)
+	if errors.IsConflict(err) {
+		controllerLog.WithFields(log.Fields{
+			"namespace": secret.Namespace,
+			"name":      secret.Name,
+		}).Warn("secret was changed while patching it, will retry")
+	}
+
+	return patched, err
+}
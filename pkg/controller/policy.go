@@ -0,0 +1,185 @@
+package controller
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	informers "github.com/travis-ci/trvs-operator/pkg/client/informers/externalversions/travisci/v1"
+	listers "github.com/travis-ci/trvs-operator/pkg/client/listers/travisci/v1"
+)
+
+const (
+	Forbidden       = "Forbidden"
+	MessageNoPolicy = "No TrvsSecretPolicy for namespace %q allows %s"
+)
+
+// PolicyAuthorizer decides whether a TrvsSecret may be generated, based on the
+// TrvsSecretPolicies that apply to its namespace. A TrvsSecret is allowed if
+// any of them allows it.
+type PolicyAuthorizer struct {
+	policies         listers.TrvsSecretPolicyLister
+	policiesSynced   cache.InformerSynced
+	namespaces       corelisters.NamespaceLister
+	namespacesSynced cache.InformerSynced
+
+	// requirePolicy denies everything in namespaces that no policy applies
+	// to. Otherwise such namespaces are unrestricted.
+	mu            sync.RWMutex
+	requirePolicy bool
+}
+
+func NewPolicyAuthorizer(policyInformer informers.TrvsSecretPolicyInformer, namespaceInformer coreinformers.NamespaceInformer, requirePolicy bool) *PolicyAuthorizer {
+	return &PolicyAuthorizer{
+		policies:         policyInformer.Lister(),
+		policiesSynced:   policyInformer.Informer().HasSynced,
+		namespaces:       namespaceInformer.Lister(),
+		namespacesSynced: namespaceInformer.Informer().HasSynced,
+		requirePolicy:    requirePolicy,
+	}
+}
+
+// SetRequirePolicy changes whether namespaces that no policy applies to are
+// denied everything.
+func (a *PolicyAuthorizer) SetRequirePolicy(require bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.requirePolicy = require
+}
+
+func (a *PolicyAuthorizer) HasSynced() bool {
+	return a.policiesSynced() && a.namespacesSynced()
+}
+
+// Authorize returns why a TrvsSecret with spec isn't allowed in namespace, or
+// an empty string if it is.
+func (a *PolicyAuthorizer) Authorize(namespace string, spec travisv1.TrvsSecretSpec) (string, error) {
+	policies, err := a.policies.List(labels.Everything())
+	if err != nil {
+		return "", err
+	}
+
+	applied := false
+	for _, p := range policies {
+		ok, err := a.appliesTo(p, namespace)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+
+		applied = true
+		if policyAllows(p, spec) {
+			return "", nil
+		}
+	}
+
+	a.mu.RLock()
+	requirePolicy := a.requirePolicy
+	a.mu.RUnlock()
+
+	if !applied && !requirePolicy {
+		return "", nil
+	}
+
+	return fmt.Sprintf(MessageNoPolicy, namespace, describeRequest(spec)), nil
+}
+
+func (a *PolicyAuthorizer) appliesTo(p *travisv1.TrvsSecretPolicy, namespace string) (bool, error) {
+	for _, ns := range p.Spec.Namespaces {
+		if ns == namespace {
+			return true, nil
+		}
+	}
+
+	if p.Spec.NamespaceSelector == nil {
+		return false, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(p.Spec.NamespaceSelector)
+	if err != nil {
+		controllerLog.WithError(err).WithField("policy", p.Name).Error("invalid namespace selector")
+		return false, nil
+	}
+
+	ns, err := a.namespaces.Get(namespace)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return selector.Matches(labels.Set(ns.Labels)), nil
+}
+
+func policyAllows(p *travisv1.TrvsSecretPolicy, spec travisv1.TrvsSecretSpec) bool {
+	if !matchesAny(p.Spec.Keychains, keychainName(spec.IsPro)) {
+		return false
+	}
+
+	// a file can hold anything, including the config of apps the policy
+	// doesn't allow, so files have to be allowed explicitly
+	if spec.File != "" {
+		return validFile(spec.File) && len(p.Spec.Files) > 0 && matchesAny(p.Spec.Files, path.Clean(spec.File))
+	}
+
+	return matchesAny(p.Spec.Apps, spec.App) && matchesAny(p.Spec.Environments, spec.Environment)
+}
+
+// sameRequest reports whether two specs request the same thing, as far as
+// policies are concerned.
+func sameRequest(a, b travisv1.TrvsSecretSpec) bool {
+	return a.IsPro == b.IsPro && a.App == b.App && a.Environment == b.Environment && a.File == b.File
+}
+
+// validFile reports whether file stays inside the keychain it is read from.
+// Otherwise a policy that only allows one keychain could be bypassed with a
+// path like "../travis-pro-keychain/...".
+func validFile(file string) bool {
+	if path.IsAbs(file) {
+		return false
+	}
+
+	clean := path.Clean(file)
+	return clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// matchesAny reports whether value matches one of the glob patterns. An empty
+// list matches anything.
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func keychainName(isPro bool) string {
+	if isPro {
+		return "com"
+	}
+	return "org"
+}
+
+func describeRequest(spec travisv1.TrvsSecretSpec) string {
+	if spec.File != "" {
+		return fmt.Sprintf("file %q from the %s keychain", spec.File, keychainName(spec.IsPro))
+	}
+	return fmt.Sprintf("app %q in env %q from the %s keychain", spec.App, spec.Environment, keychainName(spec.IsPro))
+}
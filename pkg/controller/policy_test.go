@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"encoding/json"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+)
+
+// forbidApp stands in for policies that forbid one app.
+type forbidApp string
+
+func (forbidApp) HasSynced() bool { return true }
+
+func (a forbidApp) Authorize(namespace string, spec travisv1.TrvsSecretSpec) (string, error) {
+	if spec.App == string(a) {
+		return "app is forbidden", nil
+	}
+	return "", nil
+}
+
+func TestPolicyAllowsOnlyFilesInsideTheKeychain(t *testing.T) {
+	appFiles := &travisv1.TrvsSecretPolicy{
+		Spec: travisv1.TrvsSecretPolicySpec{Keychains: []string{"org"}, Files: []string{"app/*"}},
+	}
+	certs := &travisv1.TrvsSecretPolicy{
+		Spec: travisv1.TrvsSecretPolicySpec{Keychains: []string{"org"}, Files: []string{"certs/*"}},
+	}
+
+	for _, tt := range []struct {
+		policy *travisv1.TrvsSecretPolicy
+		file   string
+		want   bool
+	}{
+		{appFiles, "app/key", true},
+		{appFiles, "./app/key", true},
+		{appFiles, "../travis-pro-keychain/app/key", false},
+		{appFiles, "app/../../travis-pro-keychain/app/key", false},
+		{appFiles, "..", false},
+		{appFiles, "/etc/passwd", false},
+		{certs, "certs/tls.pem", true},
+		{certs, "certs/../app/key", false},
+		{certs, "./certs/tls.pem", true},
+	} {
+		spec := travisv1.TrvsSecretSpec{File: tt.file}
+		if got := policyAllows(tt.policy, spec); got != tt.want {
+			t.Errorf("policy %v allows file %q: got %t, want %t", tt.policy.Spec, tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyOnlyAllowsListedFiles(t *testing.T) {
+	for _, spec := range []travisv1.TrvsSecretPolicySpec{
+		{},
+		{Keychains: []string{"org"}},
+		{Keychains: []string{"org"}, Apps: []string{"app"}, Environments: []string{"production"}},
+	} {
+		policy := &travisv1.TrvsSecretPolicy{Spec: spec}
+
+		if !policyAllows(policy, travisv1.TrvsSecretSpec{App: "app", Environment: "production"}) {
+			t.Errorf("policy %v doesn't allow the app it allows", spec)
+		}
+		if policyAllows(policy, travisv1.TrvsSecretSpec{File: "other-app/production.json"}) {
+			t.Errorf("policy %v allows a file without listing any", spec)
+		}
+	}
+}
+
+func TestWebhookDeniesFilesOutsideTheKeychain(t *testing.T) {
+	h := &webhookHandler{policies: allowAll{}}
+
+	for file, allowed := range map[string]bool{
+		"app/key":                        true,
+		"../travis-pro-keychain/app/key": false,
+		"/etc/passwd":                    false,
+	} {
+		raw, err := json.Marshal(&travisv1.TrvsSecret{Spec: travisv1.TrvsSecretSpec{File: file}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := h.review(&admissionRequest{
+			Namespace: "default",
+			Operation: "CREATE",
+			Object:    runtime.RawExtension{Raw: raw},
+		})
+		if resp.Allowed != allowed {
+			t.Errorf("file %q: allowed is %t, want %t", file, resp.Allowed, allowed)
+		}
+	}
+}
+
+func TestWebhookAdmitsUpdatesThatDontChangeTheRequest(t *testing.T) {
+	h := &webhookHandler{policies: forbidApp("forbidden")}
+
+	trvsSecret := func(app string, suspend bool, finalizers ...string) runtime.RawExtension {
+		ts := &travisv1.TrvsSecret{Spec: travisv1.TrvsSecretSpec{App: app, Environment: "production", Suspend: suspend}}
+		ts.Finalizers = finalizers
+		raw, err := json.Marshal(ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return runtime.RawExtension{Raw: raw}
+	}
+
+	for _, tt := range []struct {
+		desc        string
+		operation   string
+		old, object runtime.RawExtension
+		allowed     bool
+	}{
+		{"creating a forbidden TrvsSecret", "CREATE", runtime.RawExtension{}, trvsSecret("forbidden", false), false},
+		{"adding a finalizer", "UPDATE", trvsSecret("forbidden", false), trvsSecret("forbidden", false, secretFinalizer), true},
+		{"pausing", "UPDATE", trvsSecret("forbidden", false), trvsSecret("forbidden", true), true},
+		{"switching to a forbidden app", "UPDATE", trvsSecret("app", false), trvsSecret("forbidden", false), false},
+		{"switching to an allowed app", "UPDATE", trvsSecret("forbidden", false), trvsSecret("app", false), true},
+	} {
+		resp := h.review(&admissionRequest{
+			Namespace: "default",
+			Operation: tt.operation,
+			Object:    tt.object,
+			OldObject: tt.old,
+		})
+		if resp.Allowed != tt.allowed {
+			t.Errorf("%s: allowed is %t, want %t", tt.desc, resp.Allowed, tt.allowed)
+		}
+	}
+}
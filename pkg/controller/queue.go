@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"context"
+	"golang.org/x/time/rate"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// QueueOptions tunes how TrvsSecrets are queued and retried.
+type QueueOptions struct {
+	// RetryBaseDelay and RetryMaxDelay bound the exponential backoff of a
+	// TrvsSecret that keeps failing.
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	// QPS and Burst limit how fast retries happen across all TrvsSecrets.
+	QPS   float64
+	Burst int
+}
+
+// DefaultQueueOptions are the same as those of workqueue's default rate
+// limiter.
+var DefaultQueueOptions = QueueOptions{
+	RetryBaseDelay: 5 * time.Millisecond,
+	RetryMaxDelay:  1000 * time.Second,
+	QPS:            10,
+	Burst:          100,
+}
+
+func (o QueueOptions) rateLimiter() workqueue.RateLimiter {
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(o.RetryBaseDelay, o.RetryMaxDelay),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(o.QPS), o.Burst)},
+	)
+}
+
+// enqueueBulk queues a TrvsSecret that needs checking because of a keychain
+// or trvs change or a periodic resync, rather than because it was changed.
+// These only reach the workers when they have nothing more urgent to do.
+func (c *Controller) enqueueBulk(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.bulk.Add(key)
+}
+
+// runBulkFeeder moves TrvsSecrets from the bulk queue to the work queue
+// whenever fewer are waiting there than there are workers, until ctx is done.
+// It waits for a worker to take an item whenever the work queue is full.
+func (c *Controller) runBulkFeeder(ctx context.Context, threads int) {
+	go func() {
+		<-ctx.Done()
+		c.bulk.ShutDown()
+	}()
+
+	for {
+		key, shutdown := c.bulk.Get()
+		if shutdown {
+			return
+		}
+
+		for c.workqueue.Len() >= threads {
+			select {
+			case <-c.workTaken:
+			case <-ctx.Done():
+				c.bulk.Done(key)
+				return
+			}
+		}
+
+		c.workqueue.Add(key)
+		c.bulk.Done(key)
+	}
+}
@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestBulkFeederWaitsForWorkersToTakeWork(t *testing.T) {
+	c := &Controller{
+		workqueue: workqueue.NewRateLimitingQueue(DefaultQueueOptions.rateLimiter()),
+		bulk:      workqueue.New(),
+		workTaken: make(chan struct{}, 1),
+	}
+	defer c.workqueue.ShutDown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		c.runBulkFeeder(ctx, 1)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	c.workqueue.Add("default/urgent")
+	c.enqueueBulk(newTrvsSecret("bulk"))
+
+	time.Sleep(100 * time.Millisecond)
+	if n := c.workqueue.Len(); n != 1 {
+		t.Fatalf("workqueue has %d items while it was full, want 1", n)
+	}
+
+	// take the urgent item the way a worker does
+	if obj, _ := c.workqueue.Get(); obj != "default/urgent" {
+		t.Fatalf("workqueue has %v, want default/urgent", obj)
+	}
+	c.workTaken <- struct{}{}
+
+	deadline := time.Now().Add(time.Second)
+	for c.workqueue.Len() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("bulk item didn't reach the workqueue after a worker took work")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if obj, _ := c.workqueue.Get(); obj != "bulk" {
+		t.Errorf("workqueue has %v, want bulk", obj)
+	}
+}
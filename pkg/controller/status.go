@@ -0,0 +1,100 @@
+package controller
+
+import (
+	log "github.com/sirupsen/logrus"
+	"reflect"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	"github.com/travis-ci/trvs-operator/pkg/trvssecret"
+)
+
+// updateStatus applies update to the status of ts and saves it if anything
+// changed.
+func (c *Controller) updateStatus(ts *travisv1.TrvsSecret, update func(*travisv1.TrvsSecretStatus)) error {
+	status := ts.Status.DeepCopy()
+	status.ObservedGeneration = ts.Generation
+	update(status)
+
+	if reflect.DeepEqual(*status, ts.Status) {
+		return nil
+	}
+
+	ts = ts.DeepCopy()
+	ts.Status = *status
+	_, err := c.travisclient.TravisciV1().TrvsSecrets(ts.Namespace).UpdateStatus(ts)
+	if err != nil {
+		controllerLog.WithError(err).WithFields(log.Fields{
+			"namespace": ts.Namespace,
+			"name":      ts.Name,
+		}).Error("could not update status")
+	}
+
+	return err
+}
+
+// setCondition sets a condition in status. The transition time only changes
+// when the condition's status does.
+func setCondition(status *travisv1.TrvsSecretStatus, now time.Time, t travisv1.TrvsSecretConditionType, s v1.ConditionStatus, reason, message string) {
+	cond := travisv1.TrvsSecretCondition{
+		Type:               t,
+		Status:             s,
+		LastTransitionTime: metav1.NewTime(now),
+		Reason:             reason,
+		Message:            message,
+	}
+
+	for i, existing := range status.Conditions {
+		if existing.Type != t {
+			continue
+		}
+
+		if existing.Status == s {
+			cond.LastTransitionTime = existing.LastTransitionTime
+		}
+		status.Conditions[i] = cond
+		return
+	}
+
+	status.Conditions = append(status.Conditions, cond)
+}
+
+func hasCondition(status *travisv1.TrvsSecretStatus, t travisv1.TrvsSecretConditionType) bool {
+	for _, c := range status.Conditions {
+		if c.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// resyncRequested returns the value of the resync-at annotation of ts if it
+// hasn't been handled yet.
+func resyncRequested(ts *travisv1.TrvsSecret) string {
+	resyncAt := ts.Annotations[trvssecret.ResyncAtAnnotation]
+	if resyncAt == ts.Status.LastResyncAt {
+		return ""
+	}
+
+	return resyncAt
+}
+
+// resync fetches the keychain used by ts right away and generates its data
+// without using cached trvs output.
+func (c *Controller) resync(ts *travisv1.TrvsSecret) (map[string][]byte, string, error) {
+	change, err := c.keychains.Update(ts.Spec.IsPro)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// the watcher won't see this change any more, so pass it on to everything
+	// else it affects
+	if change != nil {
+		c.enqueueKeychainSecrets(change)
+	}
+
+	return c.generator.Regenerate(ts.Spec)
+}
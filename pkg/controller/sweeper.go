@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"time"
+
+	"github.com/travis-ci/trvs-operator/pkg/trvssecret"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// managedByLabel marks secrets created by the operator, so orphans can be
+// found without relying on owner references.
+const managedByLabel = "app.kubernetes.io/managed-by"
+
+const (
+	OrphanDetected = "OrphanDetected"
+	OrphanDeleted  = "OrphanDeleted"
+)
+
+// SweepOptions configures the periodic cleanup of orphaned secrets.
+type SweepOptions struct {
+	// Period is how often to look for orphans. Zero disables sweeping.
+	Period time.Duration
+
+	// DryRun reports orphans with an event instead of deleting them.
+	DryRun bool
+}
+
+// SetSweep changes how orphaned secrets are cleaned up. It takes effect
+// right away, even while the sweeper is waiting for the next sweep.
+func (c *Controller) SetSweep(sweep SweepOptions) {
+	c.sweepMu.Lock()
+	c.sweep = sweep
+	c.sweepMu.Unlock()
+
+	select {
+	case c.sweepChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Controller) sweepOptions() SweepOptions {
+	c.sweepMu.Lock()
+	defer c.sweepMu.Unlock()
+	return c.sweep
+}
+
+// runSweeper sweeps for orphaned secrets every period until ctx is done,
+// starting over whenever the sweep options change.
+func (c *Controller) runSweeper(ctx context.Context) {
+	var last SweepOptions
+	for {
+		sweep := c.sweepOptions()
+		if sweep != last {
+			controllerLog.WithFields(log.Fields{
+				"period":  sweep.Period,
+				"dry_run": sweep.DryRun,
+			}).Info("configured orphan sweeper")
+			last = sweep
+		}
+
+		var timer *time.Timer
+		var tick <-chan time.Time
+		if sweep.Period > 0 {
+			timer = time.NewTimer(sweep.Period)
+			tick = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-c.sweepChanged:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-tick:
+			c.sweepOrphans()
+		}
+	}
+}
+
+// sweepOrphans finds secrets managed by the operator that no TrvsSecret
+// claims any more, and deletes them.
+func (c *Controller) sweepOrphans() {
+	selector := labels.SelectorFromSet(labels.Set{managedByLabel: controllerAgentName})
+	secrets, err := c.secretsLister.List(selector)
+	if err != nil {
+		controllerLog.WithError(err).Error("could not list managed secrets")
+		return
+	}
+
+	for _, secret := range secrets {
+		reason := c.orphanReason(secret)
+		if reason == "" {
+			continue
+		}
+
+		entry := controllerLog.WithFields(log.Fields{
+			"namespace": secret.Namespace,
+			"name":      secret.Name,
+			"reason":    reason,
+		})
+
+		if c.sweepOptions().DryRun {
+			entry.Warn("found orphaned secret")
+			c.recorder.Eventf(secret, v1.EventTypeWarning, OrphanDetected, "Secret is orphaned: %s", reason)
+			continue
+		}
+
+		// make sure we don't delete a secret that was replaced in the meantime
+		uid := secret.UID
+		err := c.kubeclient.CoreV1().Secrets(secret.Namespace).Delete(secret.Name, &metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &uid},
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			entry.WithError(err).Error("could not delete orphaned secret")
+			continue
+		}
+
+		entry.Info("deleted orphaned secret")
+		c.recorder.Eventf(secret, v1.EventTypeNormal, OrphanDeleted, "Deleted orphaned secret: %s", reason)
+	}
+}
+
+// orphanReason explains why a managed secret is orphaned, or returns an empty
+// string if its TrvsSecret still claims it.
+func (c *Controller) orphanReason(secret *v1.Secret) string {
+	var owner string
+	var ownerUID types.UID
+
+	if ref := metav1.GetControllerOf(secret); ref != nil {
+		if ref.Kind != "TrvsSecret" {
+			return ""
+		}
+		owner = ref.Name
+		ownerUID = ref.UID
+	} else {
+		owner = secret.Labels[trvssecret.OwnerLabel]
+	}
+
+	if owner == "" {
+		return "no owning TrvsSecret is recorded"
+	}
+
+	ts, err := c.trvsLister.TrvsSecrets(secret.Namespace).Get(owner)
+	if errors.IsNotFound(err) {
+		return "TrvsSecret " + owner + " no longer exists"
+	}
+	if err != nil {
+		controllerLog.WithError(err).WithField("owner", owner).Error("could not get owner of secret")
+		return ""
+	}
+
+	if ownerUID != "" && ts.UID != ownerUID {
+		return "TrvsSecret " + owner + " was recreated"
+	}
+
+	if secretName(ts) != secret.Name {
+		return "TrvsSecret " + owner + " now targets " + secretName(ts)
+	}
+
+	return ""
+}
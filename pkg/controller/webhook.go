@@ -0,0 +1,147 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+)
+
+// The admission API isn't vendored, so these mirror the parts of
+// admission.k8s.io/v1beta1 AdmissionReview that the webhook uses.
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion,omitempty"`
+	Kind       string             `json:"kind,omitempty"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       types.UID            `json:"uid"`
+	Namespace string               `json:"namespace,omitempty"`
+	Operation string               `json:"operation"`
+	Object    runtime.RawExtension `json:"object,omitempty"`
+	OldObject runtime.RawExtension `json:"oldObject,omitempty"`
+}
+
+type admissionResponse struct {
+	UID     types.UID      `json:"uid"`
+	Allowed bool           `json:"allowed"`
+	Result  *metav1.Status `json:"status,omitempty"`
+}
+
+// WebhookOptions configures the admission webhook server.
+type WebhookOptions struct {
+	Addr     string
+	CertFile string
+	KeyFile  string
+}
+
+// ServeWebhook serves the validating admission webhook for TrvsSecrets, which
+// rejects those that no policy allows before they are stored.
+func ServeWebhook(opts WebhookOptions, policies Authorizer) {
+	mux := http.NewServeMux()
+	mux.Handle("/validate-trvssecret", &webhookHandler{policies: policies})
+
+	entry := controllerLog.WithField("addr", opts.Addr)
+	entry.Info("serving admission webhook")
+
+	if err := http.ListenAndServeTLS(opts.Addr, opts.CertFile, opts.KeyFile, mux); err != nil {
+		entry.WithError(err).Error("could not serve admission webhook")
+	}
+}
+
+type webhookHandler struct {
+	policies Authorizer
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var review admissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(w, "could not decode admission review", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = h.review(review.Request)
+	review.Request = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		controllerLog.WithError(err).Error("could not write admission response")
+	}
+}
+
+func (h *webhookHandler) review(req *admissionRequest) *admissionResponse {
+	resp := &admissionResponse{UID: req.UID, Allowed: true}
+	entry := controllerLog.WithFields(log.Fields{
+		"namespace": req.Namespace,
+		"operation": req.Operation,
+	})
+
+	// the listers would be empty, which could let anything through
+	if !h.policies.HasSynced() {
+		return deny(resp, http.StatusServiceUnavailable, "policies have not been loaded yet")
+	}
+
+	var ts travisv1.TrvsSecret
+	if err := json.Unmarshal(req.Object.Raw, &ts); err != nil {
+		entry.WithError(err).Error("could not decode TrvsSecret in admission request")
+		return deny(resp, http.StatusBadRequest, fmt.Sprintf("could not decode TrvsSecret: %v", err))
+	}
+
+	// deletions have to go ahead even if a policy changed in the meantime
+	if ts.DeletionTimestamp != nil {
+		return resp
+	}
+
+	// neither can updates that don't change what is requested, such as the
+	// operator's finalizers or pausing and resyncing, be held up by a policy
+	// that changed after the TrvsSecret was admitted
+	if req.Operation == "UPDATE" {
+		var old travisv1.TrvsSecret
+		if err := json.Unmarshal(req.OldObject.Raw, &old); err == nil && sameRequest(old.Spec, ts.Spec) {
+			return resp
+		}
+	}
+
+	if ts.Spec.File != "" && !validFile(ts.Spec.File) {
+		return deny(resp, http.StatusUnprocessableEntity, fmt.Sprintf("file %q must be a relative path inside the keychain", ts.Spec.File))
+	}
+
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = ts.Namespace
+	}
+
+	reason, err := h.policies.Authorize(namespace, ts.Spec)
+	if err != nil {
+		entry.WithError(err).Error("could not check policies")
+		return deny(resp, http.StatusInternalServerError, err.Error())
+	}
+	if reason != "" {
+		entry.WithFields(log.Fields{
+			"name":   ts.Name,
+			"reason": reason,
+		}).Info("denied TrvsSecret")
+		return deny(resp, http.StatusForbidden, reason)
+	}
+
+	return resp
+}
+
+func deny(resp *admissionResponse, code int32, message string) *admissionResponse {
+	resp.Allowed = false
+	resp.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    code,
+		Reason:  metav1.StatusReasonForbidden,
+		Message: message,
+	}
+	return resp
+}
@@ -0,0 +1,95 @@
+package controller
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	"github.com/travis-ci/trvs-operator/pkg/trvssecret"
+)
+
+const (
+	UpdateWorkload        = "UpdateWorkload"
+	MessageUpdateWorkload = "Pointed %s %q at secret %q"
+)
+
+// updateWorkloads points every workload that follows ts at the secret called
+// current. Only references to ts's own secrets are changed.
+func (c *Controller) updateWorkloads(ts *travisv1.TrvsSecret, current string) error {
+	names := map[string]bool{
+		secretName(ts): true,
+	}
+	history, err := c.history(ts)
+	if err != nil {
+		return err
+	}
+	for _, s := range history {
+		names[s.Name] = true
+	}
+
+	rewrite := func(spec *v1.PodSpec) bool {
+		return trvssecret.RewriteSecretRefs(spec, names, current)
+	}
+
+	apps := c.kubeclient.AppsV1()
+	opts := metav1.ListOptions{}
+
+	deployments, err := apps.Deployments(ts.Namespace).List(opts)
+	if err != nil {
+		return err
+	}
+	for i := range deployments.Items {
+		d := deployments.Items[i].DeepCopy()
+		if !trvssecret.FollowsTrvsSecret(d.ObjectMeta, ts) || !rewrite(&d.Spec.Template.Spec) {
+			continue
+		}
+		if _, err := apps.Deployments(d.Namespace).Update(d); err != nil {
+			return err
+		}
+		c.workloadUpdated(ts, "Deployment", d.Name, current)
+	}
+
+	statefulSets, err := apps.StatefulSets(ts.Namespace).List(opts)
+	if err != nil {
+		return err
+	}
+	for i := range statefulSets.Items {
+		s := statefulSets.Items[i].DeepCopy()
+		if !trvssecret.FollowsTrvsSecret(s.ObjectMeta, ts) || !rewrite(&s.Spec.Template.Spec) {
+			continue
+		}
+		if _, err := apps.StatefulSets(s.Namespace).Update(s); err != nil {
+			return err
+		}
+		c.workloadUpdated(ts, "StatefulSet", s.Name, current)
+	}
+
+	daemonSets, err := apps.DaemonSets(ts.Namespace).List(opts)
+	if err != nil {
+		return err
+	}
+	for i := range daemonSets.Items {
+		d := daemonSets.Items[i].DeepCopy()
+		if !trvssecret.FollowsTrvsSecret(d.ObjectMeta, ts) || !rewrite(&d.Spec.Template.Spec) {
+			continue
+		}
+		if _, err := apps.DaemonSets(d.Namespace).Update(d); err != nil {
+			return err
+		}
+		c.workloadUpdated(ts, "DaemonSet", d.Name, current)
+	}
+
+	return nil
+}
+
+func (c *Controller) workloadUpdated(ts *travisv1.TrvsSecret, kind, name, current string) {
+	controllerLog.WithFields(log.Fields{
+		"namespace": ts.Namespace,
+		"kind":      kind,
+		"name":      name,
+		"secret":    current,
+	}).Info("updated workload")
+	c.recorder.Eventf(ts, v1.EventTypeNormal, UpdateWorkload, MessageUpdateWorkload, kind, name, current)
+}
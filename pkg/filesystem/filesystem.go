@@ -0,0 +1,63 @@
+// Package filesystem abstracts the file operations the keychains and trvs do
+// themselves, so they can be swapped out in tests or when embedding them.
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Interface is what the keychains and trvs need from a filesystem.
+//
+// Git checks out into the directories they manage and trvs reads the
+// keychains from them, neither of which goes through Interface, so an
+// implementation has to end up on the local disk. Most wrap OS, to fail or
+// record some operations.
+type Interface interface {
+	MkdirAll(path string, perm os.FileMode) error
+	RemoveAll(path string) error
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	TempDir(dir, prefix string) (string, error)
+	Symlink(oldname, newname string) error
+	EvalSymlinks(path string) (string, error)
+}
+
+// OS is the local filesystem.
+var OS Interface = osFilesystem{}
+
+type osFilesystem struct{}
+
+func (osFilesystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFilesystem) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFilesystem) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (osFilesystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(name, data, perm)
+}
+
+func (osFilesystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+func (osFilesystem) TempDir(dir, prefix string) (string, error) {
+	return ioutil.TempDir(dir, prefix)
+}
+
+func (osFilesystem) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func (osFilesystem) EvalSymlinks(path string) (string, error) {
+	return filepath.EvalSymlinks(path)
+}
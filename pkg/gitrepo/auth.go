@@ -0,0 +1,355 @@
+package gitrepo
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuthSSH       = "ssh"
+	AuthToken     = "token"
+	AuthGitHubApp = "github-app"
+)
+
+// AuthProvider supplies credentials for a Git repository. It is asked for them
+// before every clone or fetch, so credentials that expire can be refreshed.
+type AuthProvider interface {
+	Auth() (transport.AuthMethod, error)
+}
+
+// AuthOptions configures how to authenticate with a single repository.
+type AuthOptions struct {
+	// Method is one of AuthSSH, AuthToken or AuthGitHubApp.
+	Method string
+
+	// SecretsDir holds the credential files for the repository, each named
+	// after the repository with an extension for the kind of credential:
+	//
+	//   ssh:        NAME.key, and optionally NAME.passphrase and NAME.known_hosts
+	//   token:      NAME.token
+	//   github-app: NAME.app-id, NAME.installation-id and NAME.app-key
+	SecretsDir string
+
+	// KnownHosts are known_hosts lines to check SSH host keys against. They
+	// take precedence over any known_hosts file.
+	KnownHosts []string
+
+	// KnownHostsFile is used to check SSH host keys when the repository has
+	// neither KnownHosts nor a known_hosts file of its own. The default
+	// known_hosts locations are used when all of them are missing.
+	KnownHostsFile string
+
+	// HostKeyCallback checks SSH host keys instead of any known_hosts, for
+	// programs that verify them some other way.
+	HostKeyCallback gossh.HostKeyCallback
+
+	// GitHubAPIURL is the base URL used to request installation tokens.
+	GitHubAPIURL string
+}
+
+// NewAuth creates an AuthProvider for the repository called name.
+func NewAuth(name string, opts AuthOptions) (AuthProvider, error) {
+	switch opts.Method {
+	case "", AuthSSH:
+		return newSSHAuth(name, opts)
+	case AuthToken:
+		token, err := readSecret(opts.SecretsDir, name, "token")
+		if err != nil {
+			return nil, err
+		}
+
+		// GitHub ignores the username when a token is used as the password
+		return staticAuth{&githttp.BasicAuth{
+			Username: "x-access-token",
+			Password: token,
+		}}, nil
+	case AuthGitHubApp:
+		return newGitHubAppAuth(name, opts)
+	default:
+		return nil, fmt.Errorf("unknown auth method %q", opts.Method)
+	}
+}
+
+// NoAuth is for repositories that don't need credentials, such as local ones.
+var NoAuth AuthProvider = staticAuth{}
+
+type staticAuth struct {
+	method transport.AuthMethod
+}
+
+func (a staticAuth) Auth() (transport.AuthMethod, error) {
+	return a.method, nil
+}
+
+func newSSHAuth(name string, opts AuthOptions) (AuthProvider, error) {
+	key, err := ioutil.ReadFile(secretPath(opts.SecretsDir, name, "key"))
+	if err != nil {
+		return nil, err
+	}
+
+	passphrase, err := readSecret(opts.SecretsDir, name, "passphrase")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	keys, err := ssh.NewPublicKeys("git", key, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	callback, err := hostKeyCallback(name, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// go-git falls back to the default known_hosts locations without one
+	if callback != nil {
+		keys.HostKeyCallback = callback
+	}
+
+	return staticAuth{keys}, nil
+}
+
+// hostKeyCallback checks the host keys of the repository called name against
+// the first of opts.HostKeyCallback, opts.KnownHosts, NAME.known_hosts and
+// opts.KnownHostsFile that is set. It returns nil if none of them are.
+func hostKeyCallback(name string, opts AuthOptions) (gossh.HostKeyCallback, error) {
+	if opts.HostKeyCallback != nil {
+		return opts.HostKeyCallback, nil
+	}
+
+	if len(opts.KnownHosts) > 0 {
+		return knownHostsCallback(opts.KnownHosts)
+	}
+
+	file := secretPath(opts.SecretsDir, name, "known_hosts")
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		file = opts.KnownHostsFile
+	}
+
+	if file == "" {
+		return nil, nil
+	}
+
+	return ssh.NewKnownHostsCallback(file)
+}
+
+// knownHostsCallback checks host keys against known_hosts lines. They can only
+// be parsed from a file, which isn't needed anymore once they are.
+func knownHostsCallback(lines []string) (gossh.HostKeyCallback, error) {
+	f, err := ioutil.TempFile("", "known_hosts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return knownhosts.New(f.Name())
+}
+
+// githubAppAuth authenticates as a GitHub App installation. Installation
+// tokens expire after an hour, so a new one is requested shortly before that.
+// The current token keeps being used while that fails, until it expires.
+type githubAppAuth struct {
+	appID          string
+	installationID string
+	key            *rsa.PrivateKey
+	apiURL         string
+	client         *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func newGitHubAppAuth(name string, opts AuthOptions) (AuthProvider, error) {
+	appID, err := readSecret(opts.SecretsDir, name, "app-id")
+	if err != nil {
+		return nil, err
+	}
+
+	installationID, err := readSecret(opts.SecretsDir, name, "installation-id")
+	if err != nil {
+		return nil, err
+	}
+
+	pemBytes, err := ioutil.ReadFile(secretPath(opts.SecretsDir, name, "app-key"))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parseRSAKey(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	apiURL := opts.GitHubAPIURL
+	if apiURL == "" {
+		apiURL = "https://api.github.com"
+	}
+
+	return &githubAppAuth{
+		appID:          appID,
+		installationID: installationID,
+		key:            key,
+		apiURL:         strings.TrimSuffix(apiURL, "/"),
+		client:         &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (a *githubAppAuth) Auth() (transport.AuthMethod, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token == "" || time.Until(a.expiresAt) < 5*time.Minute {
+		if err := a.refresh(); err != nil {
+			if a.token == "" || !time.Now().Before(a.expiresAt) {
+				return nil, err
+			}
+			gitLog.WithError(err).WithField("expires_at", a.expiresAt).Warn("could not refresh installation token, using the current one")
+		}
+	}
+
+	return &githttp.BasicAuth{
+		Username: "x-access-token",
+		Password: a.token,
+	}, nil
+}
+
+func (a *githubAppAuth) refresh() error {
+	jwt, err := a.jwt(time.Now())
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/app/installations/%s/access_tokens", a.apiURL, a.installationID)
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github.machine-man-preview+json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("could not create installation token: %s", resp.Status)
+	}
+
+	var body struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+
+	a.token = body.Token
+	a.expiresAt = body.ExpiresAt
+	return nil
+}
+
+// jwt creates the token used to authenticate as the app itself, which is
+// required to request installation tokens.
+func (a *githubAppAuth) jwt(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]interface{}{
+		// allow for some clock drift between us and GitHub
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	var buf bytes.Buffer
+	buf.WriteString(enc.EncodeToString(header))
+	buf.WriteByte('.')
+	buf.WriteString(enc.EncodeToString(claims))
+
+	sum := sha256.Sum256(buf.Bytes())
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+
+	buf.WriteByte('.')
+	buf.WriteString(enc.EncodeToString(sig))
+	return buf.String(), nil
+}
+
+func parseRSAKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key is not an RSA key")
+	}
+
+	return rsaKey, nil
+}
+
+func secretPath(dir, name, ext string) string {
+	return path.Join(dir, name+"."+ext)
+}
+
+func readSecret(dir, name, ext string) (string, error) {
+	b, err := ioutil.ReadFile(secretPath(dir, name, ext))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
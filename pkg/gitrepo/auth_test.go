@@ -0,0 +1,288 @@
+package gitrepo
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+func writeSecrets(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newRSAKey(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	return key, string(pem.EncodeToMemory(block))
+}
+
+// verifyJWT checks the signature of a JWT and returns its claims.
+func verifyJWT(key *rsa.PublicKey, jwt string) (map[string]interface{}, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("JWT %q doesn't have three parts", jwt)
+	}
+
+	enc := base64.RawURLEncoding
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, fmt.Errorf("JWT signature doesn't verify: %v", err)
+	}
+
+	var header map[string]string
+	b, _ := enc.DecodeString(parts[0])
+	if err := json.Unmarshal(b, &header); err != nil || header["alg"] != "RS256" {
+		return nil, fmt.Errorf("JWT header is %s", b)
+	}
+
+	var claims map[string]interface{}
+	b, _ = enc.DecodeString(parts[1])
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func TestGitHubAppJWT(t *testing.T) {
+	key, _ := newRSAKey(t)
+	a := &githubAppAuth{appID: "1234", key: key}
+
+	now := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	jwt, err := a.jwt(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := verifyJWT(&key.PublicKey, jwt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["iss"] != "1234" {
+		t.Errorf("iss is %v, want 1234", claims["iss"])
+	}
+	if iat := claims["iat"].(float64); int64(iat) != now.Add(-time.Minute).Unix() {
+		t.Errorf("iat is %v, want a minute before now", iat)
+	}
+	if exp := claims["exp"].(float64); int64(exp) != now.Add(9*time.Minute).Unix() {
+		t.Errorf("exp is %v, want nine minutes after now", exp)
+	}
+}
+
+// tokenServer hands out numbered installation tokens, expiring at expiresAt.
+type tokenServer struct {
+	*httptest.Server
+	key *rsa.PublicKey
+
+	mu        sync.Mutex
+	issued    int
+	expiresAt time.Time
+	fail      bool
+}
+
+func newTokenServer(key *rsa.PublicKey) *tokenServer {
+	s := &tokenServer{key: key}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *tokenServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/app/installations/42/access_tokens" {
+		http.NotFound(w, r)
+		return
+	}
+
+	claims, err := verifyJWT(s.key, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if err != nil || claims["iss"] != "1234" {
+		http.Error(w, "not the app", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	s.issued++
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      fmt.Sprintf("token-%d", s.issued),
+		"expires_at": s.expiresAt,
+	})
+}
+
+func (s *tokenServer) set(expiresAt time.Time, fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expiresAt = expiresAt
+	s.fail = fail
+}
+
+func TestGitHubAppTokenRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitrepo-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, pemKey := newRSAKey(t)
+	writeSecrets(t, dir, map[string]string{
+		"repo.app-id":          "1234\n",
+		"repo.installation-id": "42\n",
+		"repo.app-key":         pemKey,
+	})
+
+	server := newTokenServer(&key.PublicKey)
+	defer server.Close()
+
+	auth, err := NewAuth("repo", AuthOptions{Method: AuthGitHubApp, SecretsDir: dir, GitHubAPIURL: server.URL + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := func() (string, error) {
+		method, err := auth.Auth()
+		if err != nil {
+			return "", err
+		}
+		return method.(*githttp.BasicAuth).Password, nil
+	}
+
+	steps := []struct {
+		desc      string
+		expiresAt time.Time
+		fail      bool
+		want      string
+	}{
+		{"first token", time.Now().Add(3 * time.Minute), false, "token-1"},
+		{"refreshing fails before the token expires", time.Now().Add(time.Hour), true, "token-1"},
+		{"token is about to expire", time.Now().Add(time.Hour), false, "token-2"},
+		{"token is still fresh", time.Now().Add(time.Hour), true, "token-2"},
+	}
+
+	for _, step := range steps {
+		server.set(step.expiresAt, step.fail)
+		got, err := token()
+		if err != nil || got != step.want {
+			t.Fatalf("%s: got %q, %v, want %q", step.desc, got, err, step.want)
+		}
+	}
+
+	a := auth.(*githubAppAuth)
+	a.mu.Lock()
+	a.expiresAt = time.Now().Add(-time.Second)
+	a.mu.Unlock()
+	server.set(time.Now().Add(time.Hour), true)
+
+	if got, err := token(); err == nil {
+		t.Fatalf("got %q from a failed refresh after the token expired", got)
+	}
+}
+
+func newHostKey(t *testing.T) gossh.PublicKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := gossh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func TestSSHHostKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitrepo-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, clientKey := newRSAKey(t)
+	hostKey, otherKey := newHostKey(t), newHostKey(t)
+	line := func(key gossh.PublicKey) string {
+		return knownhosts.Line([]string{"github.com", "127.0.0.1"}, key)
+	}
+
+	writeSecrets(t, dir, map[string]string{
+		"repo.key":          clientKey,
+		"other.key":         clientKey,
+		"other.known_hosts": line(otherKey) + "\n",
+		"global":            line(hostKey) + "\n",
+	})
+
+	rejectAll := func(string, net.Addr, gossh.PublicKey) error { return fmt.Errorf("rejected") }
+
+	tests := []struct {
+		desc   string
+		name   string
+		opts   AuthOptions
+		accept bool
+	}{
+		{"falls back to the known_hosts file", "repo", AuthOptions{KnownHostsFile: filepath.Join(dir, "global")}, true},
+		{"prefers the repo's own known_hosts", "other", AuthOptions{KnownHostsFile: filepath.Join(dir, "global")}, false},
+		{"prefers known_hosts lines", "other", AuthOptions{KnownHosts: []string{line(hostKey)}}, true},
+		{"checks against known_hosts lines", "repo", AuthOptions{KnownHosts: []string{line(otherKey)}, KnownHostsFile: filepath.Join(dir, "global")}, false},
+		{"prefers the host key callback", "repo", AuthOptions{KnownHosts: []string{line(hostKey)}, HostKeyCallback: rejectAll}, false},
+	}
+
+	for _, test := range tests {
+		test.opts.Method = AuthSSH
+		test.opts.SecretsDir = dir
+
+		auth, err := NewAuth(test.name, test.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", test.desc, err)
+		}
+		method, err := auth.Auth()
+		if err != nil {
+			t.Fatalf("%s: %v", test.desc, err)
+		}
+
+		callback := method.(*ssh.PublicKeys).HostKeyCallback
+		err = callback("github.com:22", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}, hostKey)
+		if accepted := err == nil; accepted != test.accept {
+			t.Errorf("%s: accepted the host key: %v (%v), want %v", test.desc, accepted, err, test.accept)
+		}
+	}
+}
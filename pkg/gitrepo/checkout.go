@@ -0,0 +1,79 @@
+package gitrepo
+
+import (
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CheckoutCommit writes the files of a commit to dir straight from the object
+// store, without touching the repository's worktree.
+//
+// The files are written to a temporary directory first and then renamed into
+// place, so dir either doesn't exist or contains the complete commit.
+func CheckoutCommit(r *git.Repository, h plumbing.Hash, dir string) error {
+	commit, err := r.CommitObject(h)
+	if err != nil {
+		return err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	tmp := dir + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+
+	if err := tree.Files().ForEach(func(f *object.File) error {
+		return writeFile(f, filepath.Join(tmp, f.Name))
+	}); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, dir)
+}
+
+func writeFile(f *object.File, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	if f.Mode == filemode.Symlink {
+		target, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dest)
+	}
+
+	mode := os.FileMode(0644)
+	if f.Mode == filemode.Executable {
+		mode = 0755
+	}
+
+	r, err := f.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
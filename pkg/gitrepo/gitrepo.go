@@ -0,0 +1,337 @@
+// Package gitrepo keeps local clones of remote Git repositories up to date.
+package gitrepo
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/index"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/objfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/travis-ci/trvs-operator/pkg/logging"
+)
+
+var gitLog = logging.Subsystem("git")
+
+// Interface is what keychains and trvs need from a clone. Repo implements it
+// for remote repositories.
+type Interface interface {
+	// Open prepares the clone for use.
+	Open() error
+
+	// Head returns the commit currently checked out.
+	Head() (plumbing.Hash, error)
+
+	// Sync updates the clone, returning the commits checked out before and
+	// after.
+	Sync() (from plumbing.Hash, to plumbing.Hash, err error)
+
+	// CommitObject looks up a commit in the clone.
+	CommitObject(h plumbing.Hash) (*object.Commit, error)
+
+	// Checkout writes the files of a commit to dir.
+	Checkout(h plumbing.Hash, dir string) error
+}
+
+// Options configures how repositories are cloned and fetched.
+type Options struct {
+	// Branch is the only branch that is fetched and checked out. The branch
+	// the remote's HEAD points to is used if it is empty.
+	Branch string
+
+	// Depth limits clones and fetches to this many commits. Zero fetches the
+	// full history.
+	Depth int
+}
+
+// Repo keeps a local clone of a single branch of a remote repository in
+// sync with it. Unless a branch is given, that is the remote's default branch,
+// which is looked up again with every fetch.
+//
+// Syncing fetches the branch and hard-resets the worktree to it, so
+// force-pushes and local modifications are handled. If the local clone turns
+// out to be corrupt, it's replaced with a fresh one.
+type Repo struct {
+	Path          string
+	RepositoryURL string
+	Auth          AuthProvider
+	Options       Options
+	Repository    *git.Repository
+}
+
+func New(dir, repoURL string, auth AuthProvider, opts Options) *Repo {
+	return &Repo{
+		Path:          dir,
+		RepositoryURL: repoURL,
+		Auth:          auth,
+		Options:       opts,
+	}
+}
+
+func (g *Repo) log() *log.Entry {
+	return gitLog.WithFields(log.Fields{
+		"path": g.Path,
+		"url":  g.RepositoryURL,
+	})
+}
+
+// branchRef is the remote ref that is fetched. Fetching HEAD follows the
+// remote's default branch, whatever it is called.
+func (g *Repo) branchRef() plumbing.ReferenceName {
+	if g.Options.Branch == "" {
+		return plumbing.HEAD
+	}
+	return plumbing.ReferenceName("refs/heads/" + g.Options.Branch)
+}
+
+func (g *Repo) remoteRef() plumbing.ReferenceName {
+	if g.Options.Branch == "" {
+		return plumbing.ReferenceName("refs/remotes/origin/HEAD")
+	}
+	return plumbing.ReferenceName("refs/remotes/origin/" + g.Options.Branch)
+}
+
+// Open opens the existing clone of the repository, cloning it if there isn't
+// one or if it's unusable.
+func (g *Repo) Open() error {
+	r, err := git.PlainOpen(g.Path)
+	if err == git.ErrRepositoryNotExists {
+		if err := os.MkdirAll(path.Dir(g.Path), 0777); err != nil {
+			return err
+		}
+
+		r, err = g.clone(g.Path)
+		if err != nil {
+			return err
+		}
+
+		g.Repository = r
+		return nil
+	}
+
+	if err == nil {
+		g.Repository = r
+		_, err = g.Head()
+	}
+
+	if err != nil {
+		g.log().WithError(err).Warn("could not open existing clone")
+		return g.reclone()
+	}
+
+	return nil
+}
+
+// Head returns the commit currently checked out.
+func (g *Repo) Head() (plumbing.Hash, error) {
+	ref, err := g.Repository.Head()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	if _, err := g.Repository.CommitObject(ref.Hash()); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return ref.Hash(), nil
+}
+
+// CommitObject looks up a commit in the clone.
+func (g *Repo) CommitObject(h plumbing.Hash) (*object.Commit, error) {
+	return g.Repository.CommitObject(h)
+}
+
+// Checkout writes the files of a commit to dir, see CheckoutCommit.
+func (g *Repo) Checkout(h plumbing.Hash, dir string) error {
+	return CheckoutCommit(g.Repository, h, dir)
+}
+
+// Sync fetches the branch and checks out its latest commit. It returns the
+// commits checked out before and after; they are equal if nothing changed.
+func (g *Repo) Sync() (from plumbing.Hash, to plumbing.Hash, err error) {
+	from, err = g.Head()
+	if err != nil {
+		return g.recover(from, err)
+	}
+
+	to, err = g.fetch()
+	if err != nil {
+		if isCorrupt(err) {
+			return g.recover(from, err)
+		}
+
+		g.log().WithError(err).Error("could not fetch repo")
+		return from, from, err
+	}
+
+	if to == from {
+		return from, to, nil
+	}
+
+	wt, err := g.Repository.Worktree()
+	if err != nil {
+		return g.recover(from, err)
+	}
+
+	if err := wt.Reset(&git.ResetOptions{
+		Commit: to,
+		Mode:   git.HardReset,
+	}); err != nil {
+		return g.recover(from, err)
+	}
+
+	g.log().WithFields(log.Fields{
+		"from": from.String(),
+		"to":   to.String(),
+	}).Info("updated repo")
+	return from, to, nil
+}
+
+func (g *Repo) fetch() (plumbing.Hash, error) {
+	auth, err := g.Auth.Auth()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	refSpec := config.RefSpec(fmt.Sprintf("+%s:%s", g.branchRef(), g.remoteRef()))
+	err = g.Repository.Fetch(&git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{refSpec},
+		Auth:       auth,
+		Depth:      g.Options.Depth,
+		Force:      true,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return plumbing.ZeroHash, err
+	}
+
+	ref, err := g.Repository.Reference(g.remoteRef(), true)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return ref.Hash(), nil
+}
+
+// recover replaces a corrupt clone with a fresh one, reporting the commit it
+// ends up on as the new commit.
+func (g *Repo) recover(from plumbing.Hash, cause error) (plumbing.Hash, plumbing.Hash, error) {
+	g.log().WithError(cause).Warn("repo appears to be corrupt, cloning it again")
+
+	if err := g.reclone(); err != nil {
+		return from, from, err
+	}
+
+	to, err := g.Head()
+	if err != nil {
+		return from, from, err
+	}
+
+	return from, to, nil
+}
+
+// reclone clones the repository into a temporary directory next to the
+// existing clone and then swaps it into place, so a failed clone leaves the
+// old one untouched.
+func (g *Repo) reclone() error {
+	tmp := fmt.Sprintf("%s.clone-%d", g.Path, time.Now().UnixNano())
+	r, err := g.clone(tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	old := g.Path + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+
+	if err := os.Rename(g.Path, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Rename(tmp, g.Path); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(old); err != nil {
+		g.log().WithError(err).Warn("could not remove corrupt clone")
+	}
+
+	// reopen so the storage points at the final location
+	r, err = git.PlainOpen(g.Path)
+	if err != nil {
+		return err
+	}
+
+	g.Repository = r
+	g.log().Info("replaced clone of repo")
+	return nil
+}
+
+func (g *Repo) clone(dir string) (*git.Repository, error) {
+	if g.RepositoryURL == "" {
+		return nil, fmt.Errorf("a repository URL is required when it is not already cloned")
+	}
+
+	auth, err := g.Auth.Auth()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := git.PlainClone(dir, false, &git.CloneOptions{
+		URL:           g.RepositoryURL,
+		Auth:          auth,
+		ReferenceName: g.branchRef(),
+		SingleBranch:  true,
+		Depth:         g.Options.Depth,
+	})
+	if err != nil {
+		g.log().WithError(err).Error("could not clone repo")
+		return nil, err
+	}
+
+	g.log().Info("cloned repo")
+	return r, nil
+}
+
+// isCorrupt reports whether err indicates that the local clone is damaged, as
+// opposed to a problem talking to the remote.
+func isCorrupt(err error) bool {
+	switch err {
+	case plumbing.ErrObjectNotFound,
+		plumbing.ErrReferenceNotFound,
+		plumbing.ErrInvalidType,
+		packfile.ErrReferenceDeltaNotFound,
+		packfile.ErrInvalidDelta,
+		packfile.ErrDeltaCmd,
+		objfile.ErrHeader,
+		objfile.ErrNegativeSize,
+		index.ErrMalformedSignature,
+		index.ErrInvalidChecksum:
+		return true
+	}
+
+	// packfile errors are wrapped with extra details, so they can't be
+	// compared directly
+	msg := err.Error()
+	for _, e := range []*packfile.Error{
+		packfile.ErrInvalidObject,
+		packfile.ErrZLib,
+		packfile.ErrBadSignature,
+	} {
+		if strings.HasPrefix(msg, e.Error()) {
+			return true
+		}
+	}
+
+	return false
+}
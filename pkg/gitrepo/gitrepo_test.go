@@ -0,0 +1,75 @@
+package gitrepo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+
+	"github.com/travis-ci/trvs-operator/internal/gittest"
+)
+
+func TestSyncFollowsDefaultBranch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitrepo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := gittest.NewRemote(t, dir, "main", map[string]string{"a": "1"})
+
+	g := New(filepath.Join(dir, "clone"), remote.URL, NoAuth, Options{})
+	if err := g.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	head, err := g.Head()
+	if err != nil {
+		t.Fatalf("Head: %v", err)
+	}
+	if head.String() != remote.Head() {
+		t.Fatalf("cloned %s, want %s", head, remote.Head())
+	}
+
+	want := remote.Commit(map[string]string{"a": "2"})
+
+	from, to, err := g.Sync()
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if from != head || to.String() != want {
+		t.Fatalf("Sync went from %s to %s, want %s to %s", from, to, head, want)
+	}
+
+	from, to, err = g.Sync()
+	if err != nil || from != to {
+		t.Fatalf("second Sync went from %s to %s (%v), want no change", from, to, err)
+	}
+}
+
+func TestSyncUsesGivenBranch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitrepo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := gittest.NewRemote(t, dir, "release", map[string]string{"a": "1"})
+
+	g := New(filepath.Join(dir, "clone"), remote.URL, NoAuth, Options{Branch: "release"})
+	if err := g.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	want := remote.Commit(map[string]string{"a": "2"})
+	if _, to, err := g.Sync(); err != nil || to != plumbing.NewHash(want) {
+		t.Fatalf("Sync got %s (%v), want %s", to, err, want)
+	}
+
+	missing := New(filepath.Join(dir, "missing"), remote.URL, NoAuth, Options{Branch: "master"})
+	if err := missing.Open(); err == nil {
+		t.Fatal("Open of a branch that doesn't exist succeeded")
+	}
+}
@@ -0,0 +1,275 @@
+// Package keychain keeps clones of the Travis keychain repos and hands out
+// consistent snapshots of them.
+package keychain
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	"github.com/travis-ci/trvs-operator/pkg/backoff"
+	"github.com/travis-ci/trvs-operator/pkg/filesystem"
+	"github.com/travis-ci/trvs-operator/pkg/gitrepo"
+	"github.com/travis-ci/trvs-operator/pkg/logging"
+)
+
+var keychainLog = logging.Subsystem("keychain")
+
+// Option configures an optional part of a Keychain.
+type Option func(*Keychain)
+
+// WithFilesystem sets the filesystem snapshots are managed on. It defaults to
+// filesystem.OS.
+func WithFilesystem(fs filesystem.Interface) Option {
+	return func(k *Keychain) { k.fs = fs }
+}
+
+// New opens the keychain called name from repo. dir is the directory the
+// keychains are kept in; snapshots of the keychain are written below it.
+func New(name, dir string, repo gitrepo.Interface, opts ...Option) (*Keychain, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("keychains directory is empty")
+	}
+
+	k := &Keychain{
+		Name: name,
+		Dir:  dir,
+		Repo: repo,
+		fs:   filesystem.OS,
+	}
+
+	for _, opt := range opts {
+		opt(k)
+	}
+
+	if err := k.initialize(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+type Keychain struct {
+	Name string
+	Dir  string
+	Repo gitrepo.Interface
+
+	fs filesystem.Interface
+
+	// updateMu serializes updates, since they check out the worktree
+	updateMu  sync.Mutex
+	snapshots snapshots
+	listeners []func(*Keychain)
+}
+
+func (k *Keychain) initialize() error {
+	if err := k.Repo.Open(); err != nil {
+		return err
+	}
+
+	// nothing can be reading snapshots left over from a previous run
+	if err := k.fs.RemoveAll(k.snapshotsPath()); err != nil {
+		return err
+	}
+
+	head, err := k.Repo.Head()
+	if err != nil {
+		return err
+	}
+
+	if err := k.publishSnapshot(head.String()); err != nil {
+		return err
+	}
+
+	_, err = k.Update()
+	return err
+}
+
+// Change describes the commits pulled in by a keychain update.
+type Change struct {
+	// Keychain is the name of the keychain that changed.
+	Keychain string
+	IsPro    bool
+
+	From string
+	To   string
+
+	// Paths lists every file added, modified or removed between the two
+	// commits. It is nil when the changed files couldn't be determined, in
+	// which case every secret should be considered affected.
+	Paths []string
+}
+
+// Affects reports whether a TrvsSecret with the given spec could have
+// different data after this change.
+//
+// Secrets using a file only depend on that file. Secrets generated by trvs
+// depend on any file in a directory named after their app, and on any file at
+// the top level of the keychain, which is assumed to be shared by all apps.
+func (c *Change) Affects(spec v1.TrvsSecretSpec) bool {
+	if c.Paths == nil {
+		return true
+	}
+
+	for _, p := range c.Paths {
+		if spec.File != "" {
+			if path.Clean(p) == path.Clean(spec.File) {
+				return true
+			}
+			continue
+		}
+
+		dir := path.Dir(p)
+		if dir == "." {
+			return true
+		}
+
+		for _, part := range strings.Split(dir, "/") {
+			if part == spec.App {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Update pulls the latest commits of the keychain and publishes a snapshot of
+// them. It returns nil if the latest snapshot is already up to date.
+func (k *Keychain) Update() (*Change, error) {
+	k.updateMu.Lock()
+	defer k.updateMu.Unlock()
+
+	_, to, err := k.Repo.Sync()
+	if err != nil {
+		return nil, err
+	}
+
+	// compare against what readers see rather than what the clone was on
+	// before, so a snapshot that failed to publish is retried
+	from := plumbing.NewHash(k.Commit())
+	if from == to {
+		return nil, nil
+	}
+
+	entry := keychainLog.WithField("keychain", k.Name)
+
+	change := &Change{
+		Keychain: k.Name,
+		IsPro:    k.IsPro(),
+		From:     from.String(),
+		To:       to.String(),
+	}
+
+	change.Paths, err = k.changedPaths(from, to)
+	if err != nil {
+		// this happens when the old commit is gone after a force-push or a fresh
+		// clone, so every secret will be considered affected
+		entry.WithError(err).Warn("could not determine changed files")
+	}
+
+	// readers only ever see snapshots, so publishing one is what makes the
+	// update visible, all at once
+	if err := k.publishSnapshot(change.To); err != nil {
+		entry.WithError(err).Error("could not create keychain snapshot")
+		return nil, err
+	}
+
+	entry.WithFields(log.Fields{
+		"from":  change.From,
+		"to":    change.To,
+		"paths": len(change.Paths),
+	}).Info("updated keychain")
+
+	for _, l := range k.listeners {
+		l(k)
+	}
+
+	return change, nil
+}
+
+func (k *Keychain) changedPaths(from, to plumbing.Hash) ([]string, error) {
+	fromTree, err := k.tree(from)
+	if err != nil {
+		return nil, err
+	}
+
+	toTree, err := k.tree(to)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(changes))
+	for _, c := range changes {
+		// renames are reported as a single change, so include both sides
+		if c.From.Name != "" {
+			paths = append(paths, c.From.Name)
+		}
+		if c.To.Name != "" && c.To.Name != c.From.Name {
+			paths = append(paths, c.To.Name)
+		}
+	}
+
+	return paths, nil
+}
+
+func (k *Keychain) tree(h plumbing.Hash) (*object.Tree, error) {
+	commit, err := k.Repo.CommitObject(h)
+	if err != nil {
+		return nil, err
+	}
+
+	return commit.Tree()
+}
+
+// OnUpdate registers a function to be called whenever an update pulls in new
+// commits. Listeners run synchronously from Update, before it returns.
+func (k *Keychain) OnUpdate(f func(*Keychain)) {
+	k.listeners = append(k.listeners, f)
+}
+
+// Watch updates the keychain every d until ctx is done, calling handler for
+// each update that pulls in new commits. An update that is already running
+// when ctx is done is allowed to finish.
+func (k *Keychain) Watch(ctx context.Context, d time.Duration, handler func(*Change)) {
+	b := &backoff.Backoff{Min: 5 * time.Second, Max: 5 * time.Minute}
+	entry := keychainLog.WithField("keychain", k.Name)
+	entry.Info("watching keychain")
+
+	for {
+		change, err := k.Update()
+		if err != nil {
+			if !backoff.Sleep(ctx, b.Next()) {
+				break
+			}
+			continue
+		}
+
+		b.Reset()
+		if change != nil {
+			handler(change)
+		}
+
+		if !backoff.Sleep(ctx, d) {
+			break
+		}
+	}
+
+	entry.Info("stopped watching keychain")
+}
+
+func (k *Keychain) IsPro() bool {
+	return strings.Contains(k.Name, "-pro-")
+}
@@ -0,0 +1,200 @@
+package keychain
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+
+	"github.com/travis-ci/trvs-operator/internal/gittest"
+	"github.com/travis-ci/trvs-operator/pkg/gitrepo"
+)
+
+// failingCheckouts fails checkouts while fail is set.
+type failingCheckouts struct {
+	gitrepo.Interface
+	fail bool
+}
+
+func (r *failingCheckouts) Checkout(h plumbing.Hash, dir string) error {
+	if r.fail {
+		return errors.New("disk full")
+	}
+	return r.Interface.Checkout(h, dir)
+}
+
+func newTestKeychain(t *testing.T, dir string, remote *gittest.Remote) (*Keychain, *failingCheckouts) {
+	repo := &failingCheckouts{
+		Interface: gitrepo.New(filepath.Join(dir, "travis-keychain"), remote.URL, gitrepo.NoAuth, gitrepo.Options{}),
+	}
+
+	k, err := New("travis-keychain", dir, repo)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	return k, repo
+}
+
+func readSnapshot(t *testing.T, k *Keychain, file string) string {
+	s := k.Snapshot()
+	defer s.Release()
+
+	b, err := s.ReadFile(file)
+	if err != nil {
+		t.Fatalf("ReadFile(%q): %v", file, err)
+	}
+	return string(b)
+}
+
+func TestUpdateRetriesFailedSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keychain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := gittest.NewRemote(t, filepath.Join(dir, "remote"), "main", map[string]string{"app/key": "one"})
+	k, repo := newTestKeychain(t, filepath.Join(dir, "keychains"), remote)
+	first := remote.Head()
+
+	second := remote.Commit(map[string]string{"app/key": "two"})
+
+	repo.fail = true
+	if _, err := k.Update(); err == nil {
+		t.Fatal("Update succeeded even though the snapshot couldn't be checked out")
+	}
+	if got := readSnapshot(t, k, "app/key"); got != "one" {
+		t.Fatalf("snapshot has %q after a failed update, want the old %q", got, "one")
+	}
+
+	// the clone is already on the new commit, but the snapshot isn't
+	repo.fail = false
+	change, err := k.Update()
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if change == nil {
+		t.Fatal("Update reported no change, leaving the snapshot behind the clone")
+	}
+	if change.From != first || change.To != second {
+		t.Errorf("change went from %s to %s, want %s to %s", change.From, change.To, first, second)
+	}
+	if len(change.Paths) != 1 || change.Paths[0] != "app/key" {
+		t.Errorf("changed paths are %v, want [app/key]", change.Paths)
+	}
+	if got := readSnapshot(t, k, "app/key"); got != "two" {
+		t.Fatalf("snapshot has %q, want %q", got, "two")
+	}
+
+	if change, err := k.Update(); err != nil || change != nil {
+		t.Fatalf("Update without new commits returned %+v, %v", change, err)
+	}
+}
+
+func TestSnapshotSurvivesUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keychain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := gittest.NewRemote(t, filepath.Join(dir, "remote"), "main", map[string]string{"app/key": "one"})
+	k, _ := newTestKeychain(t, filepath.Join(dir, "keychains"), remote)
+
+	old := k.Snapshot()
+	remote.Commit(map[string]string{"app/key": "two"})
+	if _, err := k.Update(); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	b, err := old.ReadFile("app/key")
+	if err != nil || string(b) != "one" {
+		t.Fatalf("held snapshot read %q (%v), want %q", b, err, "one")
+	}
+
+	old.Release()
+	if _, err := os.Stat(old.Dir); !os.IsNotExist(err) {
+		t.Fatalf("released snapshot %s wasn't removed: %v", old.Dir, err)
+	}
+}
+
+func TestReadFileStaysInsideSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keychain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := gittest.NewRemote(t, filepath.Join(dir, "remote"), "main", map[string]string{"app/key": "one"})
+	k, _ := newTestKeychain(t, filepath.Join(dir, "keychains"), remote)
+
+	outside := filepath.Join(dir, "keychains", "travis-pro-keychain-secret")
+	if err := ioutil.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := k.Snapshot()
+	defer s.Release()
+
+	if err := os.Symlink(outside, filepath.Join(s.Dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	rel, err := filepath.Rel(s.Dir, outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{rel, "app/../" + rel, outside, "link"} {
+		if b, err := s.ReadFile(file); err == nil {
+			t.Errorf("ReadFile(%q) read %q from outside the snapshot", file, b)
+		}
+	}
+
+	if got := readSnapshot(t, k, "./app/key"); got != "one" {
+		t.Errorf("ReadFile(%q) = %q, want %q", "./app/key", got, "one")
+	}
+}
+
+func TestHeldSnapshotSurvivesGoingBackToItsCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keychain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := gittest.NewRemote(t, filepath.Join(dir, "remote"), "main", map[string]string{"app/key": "one"})
+	k, _ := newTestKeychain(t, filepath.Join(dir, "keychains"), remote)
+	first := remote.Head()
+
+	held := k.Snapshot()
+
+	remote.Commit(map[string]string{"app/key": "two"})
+	if _, err := k.Update(); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	// a force-push reverting to the held snapshot's commit
+	remote.Reset(first)
+	change, err := k.Update()
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if change == nil || change.To != first {
+		t.Fatalf("Update after the revert returned %+v", change)
+	}
+
+	b, err := held.ReadFile("app/key")
+	if err != nil || string(b) != "one" {
+		t.Fatalf("held snapshot read %q (%v), want %q", b, err, "one")
+	}
+
+	held.Release()
+	if got := readSnapshot(t, k, "app/key"); got != "one" {
+		t.Fatalf("latest snapshot has %q after releasing an old one of the same commit, want %q", got, "one")
+	}
+}
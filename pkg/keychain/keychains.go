@@ -0,0 +1,50 @@
+package keychain
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Keychains holds the keychain for .org and the one for .com.
+type Keychains struct {
+	Org *Keychain
+	Com *Keychain
+}
+
+// Update pulls the latest commits of the keychain for .com if isPro is set,
+// or the one for .org otherwise. It returns nil if there was nothing new.
+func (ks Keychains) Update(isPro bool) (*Change, error) {
+	return ks.ForPro(isPro).Update()
+}
+
+// Watch watches both keychains until ctx is done, and returns once both have
+// stopped.
+func (ks Keychains) Watch(ctx context.Context, d time.Duration, handler func(*Change)) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		ks.Org.Watch(ctx, d, handler)
+	}()
+
+	go func() {
+		defer wg.Done()
+		ks.Com.Watch(ctx, d, handler)
+	}()
+
+	wg.Wait()
+}
+
+func (ks Keychains) OnUpdate(f func(*Keychain)) {
+	ks.Org.OnUpdate(f)
+	ks.Com.OnUpdate(f)
+}
+
+func (ks Keychains) ForPro(isPro bool) *Keychain {
+	if isPro {
+		return ks.Com
+	}
+	return ks.Org
+}
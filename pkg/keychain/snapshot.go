@@ -0,0 +1,190 @@
+package keychain
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Snapshot is a read-only checkout of a keychain at a single commit.
+//
+// Updating a keychain never touches an existing snapshot; it creates a new one
+// and retires the old one. A retired snapshot is removed once every reader
+// that acquired it has released it.
+type Snapshot struct {
+	Keychain *Keychain
+	Commit   string
+	Dir      string
+
+	// refs and retired are guarded by the keychain's snapshot lock
+	refs    int
+	retired bool
+}
+
+// ReadFile reads a file from the snapshot. Files outside of the snapshot,
+// whether reached through ".." or a symlink, can't be read.
+func (s *Snapshot) ReadFile(file string) ([]byte, error) {
+	fs := s.Keychain.fs
+
+	root, err := fs.EvalSymlinks(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := fs.EvalSymlinks(filepath.Join(root, file))
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(p, root+string(filepath.Separator)) {
+		return nil, fmt.Errorf("%s is outside of the %s keychain", file, s.Keychain.Name)
+	}
+
+	return fs.ReadFile(p)
+}
+
+// Release tells the keychain that the snapshot is no longer being read.
+func (s *Snapshot) Release() {
+	s.Keychain.release(s)
+}
+
+// snapshots tracks the snapshots of a keychain.
+type snapshots struct {
+	mu      sync.Mutex
+	current *Snapshot
+
+	// published counts the snapshots, so each gets a directory of its own
+	// even if the keychain goes back to the commit of an earlier one
+	published int
+}
+
+func (k *Keychain) snapshotsPath() string {
+	return path.Join(k.Dir, ".snapshots", k.Name)
+}
+
+// Snapshot returns the latest snapshot of the keychain. It stays available
+// until it is released, even if the keychain is updated in the meantime.
+func (k *Keychain) Snapshot() *Snapshot {
+	k.snapshots.mu.Lock()
+	defer k.snapshots.mu.Unlock()
+
+	s := k.snapshots.current
+	s.refs++
+	return s
+}
+
+// Commit returns the commit of the latest snapshot.
+func (k *Keychain) Commit() string {
+	k.snapshots.mu.Lock()
+	defer k.snapshots.mu.Unlock()
+
+	return k.snapshots.current.Commit
+}
+
+func (k *Keychain) release(s *Snapshot) {
+	k.snapshots.mu.Lock()
+	defer k.snapshots.mu.Unlock()
+
+	s.refs--
+	if s.retired && s.refs == 0 {
+		k.removeSnapshot(s)
+	}
+}
+
+// publishSnapshot checks out the given commit and makes it the snapshot handed
+// out to new readers.
+func (k *Keychain) publishSnapshot(commit string) error {
+	k.snapshots.mu.Lock()
+	k.snapshots.published++
+	dir := path.Join(k.snapshotsPath(), fmt.Sprintf("%s-%d", commit, k.snapshots.published))
+	k.snapshots.mu.Unlock()
+
+	if err := k.fs.MkdirAll(k.snapshotsPath(), 0755); err != nil {
+		return err
+	}
+
+	if err := k.Repo.Checkout(plumbing.NewHash(commit), dir); err != nil {
+		k.fs.RemoveAll(dir)
+		return err
+	}
+
+	s := &Snapshot{
+		Keychain: k,
+		Commit:   commit,
+		Dir:      dir,
+	}
+
+	k.snapshots.mu.Lock()
+	defer k.snapshots.mu.Unlock()
+
+	old := k.snapshots.current
+	k.snapshots.current = s
+
+	if old != nil {
+		old.retired = true
+		if old.refs == 0 {
+			k.removeSnapshot(old)
+		}
+	}
+
+	return nil
+}
+
+func (k *Keychain) removeSnapshot(s *Snapshot) {
+	if err := k.fs.RemoveAll(s.Dir); err != nil {
+		keychainLog.WithError(err).WithFields(log.Fields{
+			"keychain": k.Name,
+			"commit":   s.Commit,
+		}).Warn("could not remove keychain snapshot")
+	}
+}
+
+// Snapshots holds a snapshot of each keychain.
+type Snapshots struct {
+	Org *Snapshot
+	Com *Snapshot
+}
+
+func (ks Keychains) Snapshot() Snapshots {
+	return Snapshots{
+		Org: ks.Org.Snapshot(),
+		Com: ks.Com.Snapshot(),
+	}
+}
+
+func (s Snapshots) ForPro(isPro bool) *Snapshot {
+	if isPro {
+		return s.Com
+	}
+	return s.Org
+}
+
+// Link creates a directory with both snapshots in it, laid out the way trvs
+// expects the keychains directory to be. It is created on the filesystem of the
+// .org keychain.
+func (s Snapshots) Link() (string, error) {
+	fs := s.Org.Keychain.fs
+
+	dir, err := fs.TempDir("", "trvs-keychains")
+	if err != nil {
+		return "", err
+	}
+
+	for _, snap := range []*Snapshot{s.Org, s.Com} {
+		if err := fs.Symlink(snap.Dir, path.Join(dir, snap.Keychain.Name)); err != nil {
+			fs.RemoveAll(dir)
+			return "", err
+		}
+	}
+
+	return dir, nil
+}
+
+func (s Snapshots) Release() {
+	s.Org.Release()
+	s.Com.Release()
+}
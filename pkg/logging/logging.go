@@ -0,0 +1,284 @@
+// Package logging sets up the loggers of the operator's subsystems and keeps
+// secret values out of what they write.
+package logging
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Each subsystem has its own logger, so its level can be set separately.
+var (
+	subsystemsMu     sync.Mutex
+	subsystemLoggers = make(map[string]*log.Logger)
+)
+
+// Subsystem returns the logger of a subsystem. Packages call it once when they
+// are initialized, so every subsystem is known before Configure is called.
+func Subsystem(name string) *log.Entry {
+	subsystemsMu.Lock()
+	defer subsystemsMu.Unlock()
+
+	logger, ok := subsystemLoggers[name]
+	if !ok {
+		logger = log.New()
+		logger.AddHook(redactHook{Secrets})
+		subsystemLoggers[name] = logger
+	}
+
+	return logger.WithField("subsystem", name)
+}
+
+// Configure sets up every logger. level is a default level optionally followed
+// by per-subsystem levels, such as "info,keychain=debug". format is either
+// "text" or "json".
+func Configure(level, format string) error {
+	var formatter log.Formatter
+	switch format {
+	case "", "text":
+		formatter = &log.TextFormatter{}
+	case "json":
+		formatter = &log.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	levels, err := ParseLevels(level)
+	if err != nil {
+		return err
+	}
+
+	subsystemsMu.Lock()
+	defer subsystemsMu.Unlock()
+
+	loggers := map[string]*log.Logger{"": log.StandardLogger()}
+	for name, logger := range subsystemLoggers {
+		loggers[name] = logger
+	}
+
+	for name, logger := range loggers {
+		l, ok := levels[name]
+		if !ok {
+			l = levels[""]
+		}
+
+		logger.SetLevel(l)
+		logger.SetFormatter(formatter)
+
+		// Swapping in hooks that already redact leaves no moment in which
+		// an entry could be written unredacted.
+		hooks := make(log.LevelHooks)
+		hooks.Add(redactHook{Secrets})
+		logger.ReplaceHooks(hooks)
+	}
+
+	return nil
+}
+
+// ParseLevels parses a level as accepted by Configure into the level of each
+// subsystem, keyed by its name, and the default level, keyed by "".
+func ParseLevels(s string) (map[string]log.Level, error) {
+	levels := map[string]log.Level{"": log.InfoLevel}
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name := ""
+		if i := strings.Index(part, "="); i >= 0 {
+			name, part = part[:i], part[i+1:]
+			subsystemsMu.Lock()
+			_, ok := subsystemLoggers[name]
+			subsystemsMu.Unlock()
+			if !ok {
+				return nil, fmt.Errorf("unknown log subsystem %q", name)
+			}
+		}
+
+		l, err := log.ParseLevel(part)
+		if err != nil {
+			return nil, err
+		}
+		levels[name] = l
+	}
+
+	return levels, nil
+}
+
+// minRedactLength keeps short values like "true" or "1" from being redacted
+// everywhere they appear. This means secrets shorter than it, such as PINs or
+// short passwords, are never redacted; a TrvsSecret shouldn't generate values
+// that short if they can end up in errors.
+const minRedactLength = 6
+
+const redacted = "[REDACTED]"
+
+// Secrets knows the secret values the operator currently generates, and is
+// used to redact them from every logger.
+var Secrets = &Redactor{}
+
+// Redactor replaces known secret values in strings. Values are registered
+// under the key of whatever they were generated for, so they are forgotten
+// once they are no longer generated.
+type Redactor struct {
+	mu       sync.RWMutex
+	values   map[string]map[string]bool
+	replacer *strings.Replacer
+}
+
+// Set registers the secret values to redact for key, replacing the ones it
+// had. Multi-line values are also redacted line by line, since they could be
+// logged in pieces.
+func (r *Redactor) Set(key string, data map[string][]byte) {
+	values := make(map[string]bool)
+	add := func(v string) {
+		v = strings.TrimSpace(v)
+		if len(v) >= minRedactLength {
+			values[v] = true
+		}
+	}
+
+	for _, v := range data {
+		add(string(v))
+		for _, line := range strings.Split(string(v), "\n") {
+			add(line)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if sameValues(r.values[key], values) {
+		return
+	}
+
+	if r.values == nil {
+		r.values = make(map[string]map[string]bool)
+	}
+	if len(values) == 0 {
+		delete(r.values, key)
+	} else {
+		r.values[key] = values
+	}
+	r.replacer = nil
+}
+
+// Remove forgets the secret values of key.
+func (r *Redactor) Remove(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.values[key]; ok {
+		delete(r.values, key)
+		r.replacer = nil
+	}
+}
+
+func sameValues(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for v := range a {
+		if !b[v] {
+			return false
+		}
+	}
+	return true
+}
+
+// Redact replaces every known secret value in s.
+func (r *Redactor) Redact(s string) string {
+	r.mu.RLock()
+	replacer := r.replacer
+	r.mu.RUnlock()
+
+	if replacer == nil {
+		replacer = r.buildReplacer()
+	}
+
+	return replacer.Replace(s)
+}
+
+func (r *Redactor) buildReplacer() *strings.Replacer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.replacer != nil {
+		return r.replacer
+	}
+
+	// replace longer values first, so a value containing another one is
+	// redacted as a whole
+	seen := make(map[string]bool)
+	var values []string
+	for _, set := range r.values {
+		for v := range set {
+			if !seen[v] {
+				seen[v] = true
+				values = append(values, v)
+			}
+		}
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+
+	pairs := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		pairs = append(pairs, v, redacted)
+	}
+
+	r.replacer = strings.NewReplacer(pairs...)
+	return r.replacer
+}
+
+// redactHook scrubs secret values from log messages and fields before they
+// are written.
+type redactHook struct {
+	redactor *Redactor
+}
+
+func (h redactHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h redactHook) Fire(entry *log.Entry) error {
+	entry.Message = h.redactor.Redact(entry.Message)
+
+	// the entry's fields can be shared with other entries, so they are copied
+	// rather than changed in place
+	data := make(log.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		data[k] = h.redactField(v)
+	}
+	entry.Data = data
+
+	return nil
+}
+
+func (h redactHook) redactField(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, int, int32, int64, uint, uint32, uint64, float64:
+		return v
+	case string:
+		return h.redactor.Redact(v)
+	case error:
+		s := v.Error()
+		if r := h.redactor.Redact(s); r != s {
+			return errors.New(r)
+		}
+		return v
+	default:
+		s := fmt.Sprint(v)
+		if r := h.redactor.Redact(s); r != s {
+			return r
+		}
+		return v
+	}
+}
@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const secret = "hunter2-supersecret"
+
+func TestRedactorSetReplacesValues(t *testing.T) {
+	r := &Redactor{}
+
+	r.Set("default/app", map[string][]byte{"PASSWORD": []byte(secret), "SHORT": []byte("1")})
+	if got := r.Redact("password is " + secret); got != "password is "+redacted {
+		t.Fatalf("Redact = %q", got)
+	}
+
+	r.Set("default/app", map[string][]byte{"PASSWORD": []byte("rotated-secret")})
+	if got := r.Redact(secret + " rotated-secret"); got != secret+" "+redacted {
+		t.Fatalf("after rotating, Redact = %q, want only the new value redacted", got)
+	}
+
+	r.Set("default/other", map[string][]byte{"TOKEN": []byte("other-token")})
+	r.Remove("default/app")
+	if got := r.Redact("rotated-secret other-token"); got != "rotated-secret "+redacted {
+		t.Fatalf("after removing, Redact = %q, want only the other value redacted", got)
+	}
+
+	if len(r.values) != 1 {
+		t.Fatalf("redactor holds values of %d keys, want 1", len(r.values))
+	}
+}
+
+func TestRedactorSplitsLines(t *testing.T) {
+	r := &Redactor{}
+	r.Set("default/app", map[string][]byte{"KEY": []byte("-----BEGIN KEY-----\nabcdefghijkl\n-----END KEY-----\n")})
+
+	if got := r.Redact("line: abcdefghijkl"); got != "line: "+redacted {
+		t.Fatalf("Redact = %q", got)
+	}
+}
+
+type stringer struct{ s string }
+
+func (s stringer) String() string { return s.s }
+
+func TestLoggersNeverWriteSecrets(t *testing.T) {
+	Secrets.Set("test/logging", map[string][]byte{"PASSWORD": []byte(secret)})
+	defer Secrets.Remove("test/logging")
+
+	for _, format := range []string{"text", "json"} {
+		if err := Configure("debug", format); err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		entry := Subsystem("test")
+		entry.Logger.Out = &out
+
+		err := fmt.Errorf("could not parse %q", secret)
+		entry.WithError(err).Error("failed")
+		entry.WithField("value", secret).Info("got value")
+		entry.WithField("value", stringer{secret}).Info("got stringer")
+		entry.WithField("values", []string{secret}).Info("got list")
+		entry.Infof("message with %s in it", secret)
+		entry.WithFields(log.Fields{"error": errors.New(secret)}).Warn("plain error")
+
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("%s output contains the secret:\n%s", format, out.String())
+		}
+		if n := strings.Count(out.String(), redacted); n != 6 {
+			t.Errorf("%s output has %d redactions, want 6:\n%s", format, n, out.String())
+		}
+	}
+}
+
+func TestShortValuesArentRedacted(t *testing.T) {
+	Secrets.Set("test/logging", map[string][]byte{"PIN": []byte("1234"), "PASSWORD": []byte(secret)})
+	defer Secrets.Remove("test/logging")
+
+	if got := Secrets.Redact("pin 1234, password " + secret); got != "pin 1234, password "+redacted {
+		t.Errorf("got %q", got)
+	}
+}
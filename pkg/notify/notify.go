@@ -0,0 +1,405 @@
+// Package notify tells people about TrvsSecrets that keep failing to sync,
+// recover, or change the data of their secrets.
+package notify
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	"github.com/travis-ci/trvs-operator/pkg/controller"
+	"github.com/travis-ci/trvs-operator/pkg/logging"
+)
+
+var notifyLog = logging.Subsystem("notify")
+
+// queueSize is how many notifications can wait to be sent before new ones are
+// dropped.
+const queueSize = 100
+
+// Events that can be notified about.
+const (
+	Failing   = "failing"
+	Recovered = "recovered"
+	Changed   = "changed"
+)
+
+// Events lists every event, in the order they are documented.
+var Events = []string{Failing, Recovered, Changed}
+
+// IsEvent reports whether s is one of Events.
+func IsEvent(s string) bool {
+	for _, e := range Events {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Notification describes something that happened to a TrvsSecret.
+type Notification struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+
+	// Failures and Error describe the failure streak of failing and recovered
+	// TrvsSecrets.
+	Failures int    `json:"failures,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// Action, Secret, KeychainCommit and Keys describe a change to the data of
+	// a secret. Only the names of the keys are included, never their values.
+	Action         string   `json:"action,omitempty"`
+	Secret         string   `json:"secret,omitempty"`
+	KeychainCommit string   `json:"keychainCommit,omitempty"`
+	Keys           []string `json:"keys,omitempty"`
+}
+
+// Summary describes the notification in a single line.
+func (n Notification) Summary() string {
+	ts := n.Namespace + "/" + n.Name
+
+	switch n.Event {
+	case Failing:
+		return fmt.Sprintf("TrvsSecret %s failed to sync %d times in a row: %s", ts, n.Failures, n.Error)
+	case Recovered:
+		return fmt.Sprintf("TrvsSecret %s synced again after %d failures", ts, n.Failures)
+	case Changed:
+		commit := n.KeychainCommit
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		return fmt.Sprintf("TrvsSecret %s changed secret %s (%s from keychain commit %s): %s",
+			ts, n.Secret, n.Action, commit, strings.Join(n.Keys, ", "))
+	default:
+		return fmt.Sprintf("TrvsSecret %s: %s", ts, n.Event)
+	}
+}
+
+// Sink delivers notifications.
+type Sink interface {
+	Send(Notification) error
+}
+
+// Route sends notifications about TrvsSecrets in some namespaces to a sink.
+type Route struct {
+	// Namespaces are the namespaces routed to Sink, as globs such as
+	// "team-*". Empty routes every namespace.
+	Namespaces []string
+
+	Sink Sink
+}
+
+func (r Route) matches(namespace string) bool {
+	if len(r.Namespaces) == 0 {
+		return true
+	}
+
+	for _, pattern := range r.Namespaces {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Notifier turns the outcome of syncs and the audit records of changed
+// secrets into notifications, and sends them along every matching route.
+//
+// A TrvsSecret is failing once it failed FailureThreshold syncs in a row, and
+// recovers with its next successful sync. A notification identical to one
+// sent less than DedupWindow ago is dropped, so a TrvsSecret that keeps
+// flapping for the same reason doesn't flood anyone.
+//
+// Notifications are sent in the background, so slow sinks don't hold up
+// syncs. Close sends the ones still waiting.
+//
+// The settings are not to be changed once the Notifier is in use, other than
+// with Reconfigure.
+type Notifier struct {
+	Routes []Route
+
+	// Events limits the events notified about. Empty notifies about all of
+	// them.
+	Events []string
+
+	FailureThreshold int
+	DedupWindow      time.Duration
+
+	// Clock is used to de-duplicate and timestamp notifications. The system
+	// clock is used if it is nil.
+	Clock clock.Clock
+
+	// Redactor redacts secret values from error messages. logging.Secrets is
+	// used if it is nil.
+	Redactor *logging.Redactor
+
+	mu      sync.Mutex
+	streaks map[string]*streak
+	// sent records when notifications were last sent, keyed by TrvsSecret and
+	// then by what makes them the same
+	sent map[string]map[string]time.Time
+
+	startOnce sync.Once
+	queue     chan delivery
+	done      chan struct{}
+}
+
+// delivery is a notification waiting to be sent to the routes it matched.
+type delivery struct {
+	notification Notification
+	routes       []Route
+}
+
+// streak tracks consecutive failures of a TrvsSecret.
+type streak struct {
+	failures int
+	err      string
+	failing  bool
+}
+
+// Reconfigure replaces the routes and settings of n with those of other,
+// while keeping track of the TrvsSecrets that are failing.
+func (n *Notifier) Reconfigure(other *Notifier) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.Routes = other.Routes
+	n.Events = other.Events
+	n.FailureThreshold = other.FailureThreshold
+	n.DedupWindow = other.DedupWindow
+}
+
+// Forget drops the failure streak and sent notifications of a TrvsSecret that
+// no longer exists.
+func (n *Notifier) Forget(namespace, name string) {
+	key := namespace + "/" + name
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.streaks, key)
+	delete(n.sent, key)
+}
+
+// Close stops the Notifier once every waiting notification has been sent.
+// Nothing may be notified afterwards.
+func (n *Notifier) Close() {
+	n.start()
+	close(n.queue)
+	<-n.done
+}
+
+// start starts sending notifications, unless it already has.
+func (n *Notifier) start() {
+	n.startOnce.Do(func() {
+		n.queue = make(chan delivery, queueSize)
+		n.done = make(chan struct{})
+		go n.run()
+	})
+}
+
+func (n *Notifier) run() {
+	defer close(n.done)
+
+	for d := range n.queue {
+		for _, route := range d.routes {
+			if err := route.Sink.Send(d.notification); err != nil {
+				notifyLog.WithError(err).WithFields(log.Fields{
+					"event":     d.notification.Event,
+					"namespace": d.notification.Namespace,
+					"name":      d.notification.Name,
+					"sink":      fmt.Sprintf("%T", route.Sink),
+				}).Error("could not send notification")
+			}
+		}
+	}
+}
+
+var _ controller.Notifier = &Notifier{}
+var _ controller.AuditSink = &Notifier{}
+
+// SyncFailed records a failed sync of a TrvsSecret, and notifies that it is
+// failing once it failed often enough in a row.
+func (n *Notifier) SyncFailed(namespace, name string, err error) {
+	key := namespace + "/" + name
+	redactor := n.Redactor
+	if redactor == nil {
+		redactor = logging.Secrets
+	}
+	msg := redactor.Redact(err.Error())
+
+	n.mu.Lock()
+	if n.streaks == nil {
+		n.streaks = make(map[string]*streak)
+	}
+	s, ok := n.streaks[key]
+	if !ok {
+		s = &streak{}
+		n.streaks[key] = s
+	}
+	s.failures++
+	s.err = msg
+
+	threshold := n.FailureThreshold
+	if threshold < 1 {
+		threshold = 1
+	}
+	notify := !s.failing && s.failures >= threshold
+	if notify {
+		s.failing = true
+	}
+	failures := s.failures
+	n.mu.Unlock()
+
+	if notify {
+		n.notify(Notification{
+			Event:     Failing,
+			Namespace: namespace,
+			Name:      name,
+			Failures:  failures,
+			Error:     msg,
+		}, msg)
+	}
+}
+
+// SyncSucceeded ends the failure streak of a TrvsSecret, and notifies that it
+// recovered if it was failing.
+func (n *Notifier) SyncSucceeded(namespace, name string) {
+	key := namespace + "/" + name
+
+	n.mu.Lock()
+	s, ok := n.streaks[key]
+	delete(n.streaks, key)
+	n.mu.Unlock()
+
+	if !ok || !s.failing {
+		return
+	}
+
+	n.notify(Notification{
+		Event:     Recovered,
+		Namespace: namespace,
+		Name:      name,
+		Failures:  s.failures,
+		Error:     s.err,
+	}, "")
+}
+
+// Write notifies about a change to the data of a secret. It lets a Notifier
+// be used as an audit sink.
+func (n *Notifier) Write(record controller.AuditRecord) error {
+	keys := make([]string, 0, len(record.Keys))
+	hashes := make([]string, 0, len(record.Keys))
+	for _, k := range record.Keys {
+		keys = append(keys, k.Name)
+		hashes = append(hashes, k.Name+"="+k.Hash)
+	}
+
+	n.notify(Notification{
+		Event:          Changed,
+		Namespace:      record.Namespace,
+		Name:           record.Name,
+		Action:         record.Action,
+		Secret:         record.Secret,
+		KeychainCommit: record.KeychainCommit,
+		Keys:           keys,
+	}, record.Secret+" "+strings.Join(hashes, ","))
+
+	return nil
+}
+
+// notify queues a notification to be sent to every route that matches it,
+// unless the same notification was sent recently. detail is what, besides the
+// event and the TrvsSecret, makes notifications the same.
+func (n *Notifier) notify(notification Notification, detail string) {
+	now := n.now()
+	notification.Time = now.UTC()
+
+	key := notification.Namespace + "/" + notification.Name
+	dedupKey := notification.Event + "\x00" + detail
+
+	n.mu.Lock()
+	if !n.wants(notification.Event) {
+		n.mu.Unlock()
+		return
+	}
+	var routes []Route
+	for _, route := range n.Routes {
+		if route.matches(notification.Namespace) {
+			routes = append(routes, route)
+		}
+	}
+	if n.sent == nil {
+		n.sent = make(map[string]map[string]time.Time)
+	}
+	for k, sent := range n.sent {
+		for d, t := range sent {
+			if now.Sub(t) >= n.DedupWindow {
+				delete(sent, d)
+			}
+		}
+		if len(sent) == 0 {
+			delete(n.sent, k)
+		}
+	}
+	_, duplicate := n.sent[key][dedupKey]
+	if !duplicate && n.DedupWindow > 0 {
+		if n.sent[key] == nil {
+			n.sent[key] = make(map[string]time.Time)
+		}
+		n.sent[key][dedupKey] = now
+	}
+	n.mu.Unlock()
+
+	entry := notifyLog.WithFields(log.Fields{
+		"event":     notification.Event,
+		"namespace": notification.Namespace,
+		"name":      notification.Name,
+	})
+
+	if duplicate {
+		entry.Debug("dropping duplicate notification")
+		return
+	}
+	if len(routes) == 0 {
+		return
+	}
+
+	n.start()
+	select {
+	case n.queue <- delivery{notification, routes}:
+	default:
+		entry.Errorf("dropping notification, %d are already waiting to be sent", queueSize)
+	}
+}
+
+// wants reports whether event is notified about. n.mu must be held.
+func (n *Notifier) wants(event string) bool {
+	if len(n.Events) == 0 {
+		return true
+	}
+
+	for _, e := range n.Events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (n *Notifier) now() time.Time {
+	if n.Clock != nil {
+		return n.Clock.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,257 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	"github.com/travis-ci/trvs-operator/pkg/controller"
+)
+
+// webhook receives the notifications posted to it.
+type webhook struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	received []Notification
+}
+
+func newWebhook() *webhook {
+	w := &webhook{}
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var n Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.mu.Lock()
+		w.received = append(w.received, n)
+		w.mu.Unlock()
+	}))
+	return w
+}
+
+func (w *webhook) events() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var events []string
+	for _, n := range w.received {
+		events = append(events, n.Event)
+	}
+	return events
+}
+
+func TestNotifiesAboutFailingAndRecoveredTrvsSecrets(t *testing.T) {
+	hook := newWebhook()
+	defer hook.Close()
+
+	n := &Notifier{
+		Routes:           []Route{{Sink: NewWebhookSink(hook.URL)}},
+		FailureThreshold: 2,
+		DedupWindow:      time.Hour,
+		Clock:            clock.NewFakeClock(time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)),
+	}
+
+	n.SyncFailed("default", "app", errors.New("trvs failed"))
+	n.SyncFailed("default", "app", errors.New("trvs failed"))
+	n.SyncFailed("default", "app", errors.New("trvs failed"))
+	n.SyncSucceeded("default", "app")
+
+	// the same streak again is a duplicate
+	n.SyncFailed("default", "app", errors.New("trvs failed"))
+	n.SyncFailed("default", "app", errors.New("trvs failed"))
+	n.Close()
+
+	if got := strings.Join(hook.events(), ","); got != "failing,recovered" {
+		t.Fatalf("sent %s, want failing,recovered", got)
+	}
+	if n := hook.received[0]; n.Failures != 2 || n.Error != "trvs failed" {
+		t.Errorf("failing notification is %+v", n)
+	}
+}
+
+func TestForgetDropsDeletedTrvsSecrets(t *testing.T) {
+	hook := newWebhook()
+	defer hook.Close()
+
+	n := &Notifier{
+		Routes:           []Route{{Sink: NewWebhookSink(hook.URL)}},
+		FailureThreshold: 1,
+		DedupWindow:      time.Hour,
+	}
+
+	n.SyncFailed("default", "app", errors.New("trvs failed"))
+	n.SyncFailed("default", "other", errors.New("trvs failed"))
+	n.Forget("default", "app")
+
+	n.mu.Lock()
+	_, streak := n.streaks["default/app"]
+	_, sent := n.sent["default/app"]
+	kept := len(n.streaks) == 1 && len(n.sent) == 1
+	n.mu.Unlock()
+	if streak || sent || !kept {
+		t.Fatalf("Forget left streaks %v and sent %v", n.streaks, n.sent)
+	}
+
+	// a new TrvsSecret of the same name starts afresh
+	n.SyncFailed("default", "app", errors.New("trvs failed"))
+	n.Close()
+
+	if got := len(hook.events()); got != 3 {
+		t.Errorf("sent %d notifications, want 3", got)
+	}
+}
+
+// blockingSink doesn't return from Send until it is released.
+type blockingSink struct {
+	release chan struct{}
+}
+
+func (s blockingSink) Send(Notification) error {
+	<-s.release
+	return nil
+}
+
+func TestSlowSinksDontBlock(t *testing.T) {
+	sink := blockingSink{release: make(chan struct{})}
+	n := &Notifier{Routes: []Route{{Sink: sink}}}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*queueSize; i++ {
+			n.Write(controller.AuditRecord{Namespace: "default", Name: "app", Secret: "app", Action: controller.AuditUpdate})
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("notifying waited for the sink")
+	}
+
+	close(sink.release)
+	n.Close()
+}
+
+// smtpServer accepts a single mail, without STARTTLS or authentication.
+type smtpServer struct {
+	net.Listener
+
+	from, to string
+	data     string
+	done     chan struct{}
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &smtpServer{Listener: l, done: make(chan struct{})}
+	go s.serve()
+	return s
+}
+
+func (s *smtpServer) serve() {
+	defer close(s.done)
+
+	conn, err := s.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch cmd {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "MAIL":
+			s.from = line
+			reply("250 OK")
+		case "RCPT":
+			s.to = line
+			reply("250 OK")
+		case "DATA":
+			reply("354 go ahead")
+			var data []string
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data = append(data, l)
+			}
+			s.data = strings.Join(data, "")
+			reply("250 OK")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestSMTPSinkSendsMail(t *testing.T) {
+	server := newSMTPServer(t)
+	defer server.Close()
+
+	sink := &SMTPSink{
+		Addr:    server.Addr().String(),
+		From:    "trvs-operator@example.com",
+		To:      []string{"team@example.com"},
+		Timeout: 5 * time.Second,
+	}
+
+	n := Notification{
+		Event:     Failing,
+		Time:      time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC),
+		Namespace: "default",
+		Name:      "app",
+		Failures:  3,
+		Error:     "trvs failed",
+	}
+	if err := sink.Send(n); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	<-server.done
+
+	if server.from != "MAIL FROM:<trvs-operator@example.com>" || server.to != "RCPT TO:<team@example.com>" {
+		t.Errorf("mail went from %q to %q", server.from, server.to)
+	}
+	for _, want := range []string{
+		"Subject: [trvs-operator] failing default/app\r\n",
+		"TrvsSecret default/app failed to sync 3 times in a row: trvs failed",
+	} {
+		if !strings.Contains(server.data, want) {
+			t.Errorf("mail doesn't contain %q:\n%s", want, server.data)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// WebhookSink posts each notification as JSON to a URL.
+type WebhookSink struct {
+	URL    string
+	client *http.Client
+}
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{
+		URL:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *WebhookSink) Send(n Notification) error {
+	return postJSON(s.client, s.URL, n)
+}
+
+// SlackSink posts notifications to a Slack incoming webhook, or anything that
+// accepts the same messages.
+type SlackSink struct {
+	URL    string
+	client *http.Client
+}
+
+func NewSlackSink(url string) *SlackSink {
+	return &SlackSink{
+		URL:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+var slackEmoji = map[string]string{
+	Failing:   ":red_circle:",
+	Recovered: ":large_green_circle:",
+	Changed:   ":key:",
+}
+
+func (s *SlackSink) Send(n Notification) error {
+	text := n.Summary()
+	if emoji, ok := slackEmoji[n.Event]; ok {
+		text = emoji + " " + text
+	}
+
+	return postJSON(s.client, s.URL, map[string]string{"text": text})
+}
+
+func postJSON(client *http.Client, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notification rejected: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// SMTPSink emails each notification. STARTTLS is used when the server offers
+// it, and the credentials are only sent if a username is set.
+type SMTPSink struct {
+	// Addr is the host:port of the mail server.
+	Addr string
+	From string
+	To   []string
+
+	Username string
+	Password string
+
+	Timeout time.Duration
+}
+
+func (s *SMTPSink) Send(n Notification) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	conn, err := net.DialTimeout("tcp", s.Addr, timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(s.From); err != nil {
+		return err
+	}
+	for _, to := range s.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(s.message(n)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+func (s *SMTPSink) message(n Notification) []byte {
+	details, _ := json.MarshalIndent(n, "", "  ")
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&b, "Subject: [trvs-operator] %s %s/%s\r\n", n.Event, n.Namespace, n.Name)
+	fmt.Fprintf(&b, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(n.Summary() + "\r\n\r\n")
+	b.WriteString(strings.Replace(string(details), "\n", "\r\n", -1) + "\r\n")
+	return b.Bytes()
+}
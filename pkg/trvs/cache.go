@@ -0,0 +1,247 @@
+package trvs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/travis-ci/trvs-operator/pkg/keychain"
+)
+
+// CacheKey identifies a single run of `trvs generate-config`. The output of
+// trvs only depends on the commits of the keychain and trvs repos and the
+// arguments it was run with, so it's safe to reuse it as long as none of these
+// change.
+type CacheKey struct {
+	KeychainCommit string
+	TrvsCommit     string
+	App            string
+	Environment    string
+	IsPro          bool
+	Format         string
+}
+
+func (key CacheKey) String() string {
+	return fmt.Sprintf("%s/%s/%s/%s/%t/%s", key.KeychainCommit, key.TrvsCommit, key.App, key.Environment, key.IsPro, key.Format)
+}
+
+// Cache holds the output of previous trvs runs in memory and, optionally, on
+// disk so that it survives restarts. The files in Dir hold generated secrets in
+// plaintext, so nothing but the operator should be able to read it.
+//
+// Only output generated from the latest commits of the keychains and trvs is
+// kept. Evict and EvictTrvs drop everything else once they move on.
+type Cache struct {
+	Dir string
+
+	options
+
+	mu      sync.Mutex
+	entries map[CacheKey][]byte
+
+	// keychainCommits and trvsCommit are the commits output is kept for, once
+	// they are known
+	keychainCommits map[bool]string
+	trvsCommit      string
+}
+
+func NewCache(dir string, opts ...Option) (*Cache, error) {
+	c := &Cache{
+		Dir:             dir,
+		options:         newOptions(opts),
+		entries:         make(map[CacheKey][]byte),
+		keychainCommits: make(map[bool]string),
+	}
+
+	if dir != "" {
+		if err := c.fs.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Fetch returns the cached output for key, calling generate and storing its
+// result if there isn't one yet.
+func (c *Cache) Fetch(key CacheKey, generate func() ([]byte, error)) ([]byte, error) {
+	entry := trvsLog.WithField("cache_key", key.String())
+
+	if out, ok := c.get(key); ok {
+		c.metrics.CacheHits.Add(1)
+		entry.Debug("trvs cache hit")
+		return out, nil
+	}
+
+	c.metrics.CacheMisses.Add(1)
+	entry.Debug("trvs cache miss")
+
+	out, err := generate()
+	if err != nil {
+		return nil, err
+	}
+
+	c.set(key, out)
+	return out, nil
+}
+
+// Refresh calls generate and stores its result for key, replacing any cached
+// output.
+func (c *Cache) Refresh(key CacheKey, generate func() ([]byte, error)) ([]byte, error) {
+	trvsLog.WithField("cache_key", key.String()).Debug("refreshing trvs cache entry")
+
+	out, err := generate()
+	if err != nil {
+		return nil, err
+	}
+
+	c.set(key, out)
+	return out, nil
+}
+
+// Evict drops every entry generated from a commit of the keychain other than
+// its latest one. It's meant to be registered as a keychain update listener.
+func (c *Cache) Evict(k *keychain.Keychain) {
+	commit := k.Commit()
+	c.evictKeychain(k.IsPro(), commit)
+
+	trvsLog.WithFields(log.Fields{"keychain": k.Name, "commit": commit}).Info("evicted trvs output of old keychain commits")
+}
+
+func (c *Cache) evictKeychain(isPro bool, commit string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.keychainCommits[isPro] = commit
+
+	for key := range c.entries {
+		if key.IsPro == isPro && key.KeychainCommit != commit {
+			delete(c.entries, key)
+		}
+	}
+
+	if c.Dir != "" {
+		c.removeExcept(c.keychainDir(isPro), commit)
+	}
+}
+
+// EvictTrvs drops every entry that wasn't generated by the given trvs commit.
+func (c *Cache) EvictTrvs(commit string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.trvsCommit = commit
+
+	for key := range c.entries {
+		if key.TrvsCommit != commit {
+			delete(c.entries, key)
+		}
+	}
+
+	if c.Dir != "" {
+		for _, isPro := range []bool{false, true} {
+			dirs, err := c.fs.ReadDir(c.keychainDir(isPro))
+			if err != nil && !os.IsNotExist(err) {
+				trvsLog.WithError(err).Error("could not list cached trvs output")
+			}
+			for _, dir := range dirs {
+				c.removeExcept(path.Join(c.keychainDir(isPro), dir.Name()), commit)
+			}
+		}
+	}
+
+	trvsLog.WithField("commit", commit).Info("evicted trvs output of old trvs commits")
+}
+
+// removeExcept removes everything in dir but keep.
+func (c *Cache) removeExcept(dir, keep string) {
+	entries, err := c.fs.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			trvsLog.WithError(err).WithField("dir", dir).Error("could not list cached trvs output")
+		}
+		return
+	}
+
+	for _, e := range entries {
+		if e.Name() == keep {
+			continue
+		}
+		if err := c.fs.RemoveAll(path.Join(dir, e.Name())); err != nil {
+			trvsLog.WithError(err).WithField("dir", dir).Error("could not remove cached trvs output")
+		}
+	}
+}
+
+// stale reports whether key was generated from a commit that has already been
+// evicted.
+func (c *Cache) stale(key CacheKey) bool {
+	if commit, ok := c.keychainCommits[key.IsPro]; ok && commit != key.KeychainCommit {
+		return true
+	}
+	return c.trvsCommit != "" && c.trvsCommit != key.TrvsCommit
+}
+
+func (c *Cache) get(key CacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if out, ok := c.entries[key]; ok {
+		return out, true
+	}
+
+	if c.Dir == "" {
+		return nil, false
+	}
+
+	out, err := c.fs.ReadFile(c.file(key))
+	if err != nil {
+		return nil, false
+	}
+
+	c.entries[key] = out
+	return out, true
+}
+
+func (c *Cache) set(key CacheKey, out []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the output of a run that started before an eviction would never be
+	// evicted itself
+	if c.stale(key) {
+		return
+	}
+
+	c.entries[key] = out
+
+	if c.Dir == "" {
+		return
+	}
+
+	entry := trvsLog.WithField("cache_key", key.String())
+	if err := c.fs.MkdirAll(path.Dir(c.file(key)), 0700); err != nil {
+		entry.WithError(err).Error("could not create cache directory")
+		return
+	}
+
+	if err := c.fs.WriteFile(c.file(key), out, 0600); err != nil {
+		entry.WithError(err).Error("could not write cached trvs output")
+	}
+}
+
+func (c *Cache) keychainDir(isPro bool) string {
+	if isPro {
+		return path.Join(c.Dir, "com")
+	}
+	return path.Join(c.Dir, "org")
+}
+
+func (c *Cache) file(key CacheKey) string {
+	sum := sha256.Sum256([]byte(key.String()))
+	return path.Join(c.keychainDir(key.IsPro), key.KeychainCommit, key.TrvsCommit, hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,171 @@
+package trvs
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/travis-ci/trvs-operator/pkg/filesystem"
+)
+
+// memFilesystem keeps files in memory.
+type memFilesystem struct {
+	filesystem.Interface
+
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (fs *memFilesystem) MkdirAll(string, os.FileMode) error { return nil }
+
+func (fs *memFilesystem) RemoveAll(dir string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for name := range fs.files {
+		if strings.HasPrefix(name, dir+"/") {
+			delete(fs.files, name)
+		}
+	}
+	return nil
+}
+
+func (fs *memFilesystem) ReadFile(name string) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	b, ok := fs.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return b, nil
+}
+
+func (fs *memFilesystem) ReadDir(dir string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var infos []os.FileInfo
+	for name := range fs.files {
+		if !strings.HasPrefix(name, dir+"/") {
+			continue
+		}
+		child := strings.SplitN(strings.TrimPrefix(name, dir+"/"), "/", 2)[0]
+		if !seen[child] {
+			seen[child] = true
+			infos = append(infos, memFileInfo(child))
+		}
+	}
+	if infos == nil {
+		return nil, os.ErrNotExist
+	}
+	return infos, nil
+}
+
+// memFileInfo describes a file or directory of a memFilesystem by its name.
+type memFileInfo string
+
+func (fi memFileInfo) Name() string       { return string(fi) }
+func (fi memFileInfo) Size() int64        { return 0 }
+func (fi memFileInfo) Mode() os.FileMode  { return 0 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+func (fs *memFilesystem) WriteFile(name string, data []byte, _ os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.files == nil {
+		fs.files = make(map[string][]byte)
+	}
+	fs.files[name] = data
+	return nil
+}
+
+func TestCacheSurvivesRestarts(t *testing.T) {
+	fs := &memFilesystem{}
+	key := CacheKey{KeychainCommit: "abc", TrvsCommit: "def", App: "app", Environment: "production", Format: "json"}
+
+	generate := func() ([]byte, error) { return []byte(`{"key": "value"}`), nil }
+	fail := func() ([]byte, error) {
+		t.Fatal("cached output was generated again")
+		return nil, nil
+	}
+
+	first, err := NewCache("/cache", WithFilesystem(fs), WithMetrics(&Metrics{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Fetch(key, generate); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.files) != 1 {
+		t.Fatalf("cache wrote %d files, want 1", len(fs.files))
+	}
+
+	metrics := &Metrics{}
+	second, err := NewCache("/cache", WithFilesystem(fs), WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := second.Fetch(key, fail)
+	if err != nil || string(out) != `{"key": "value"}` {
+		t.Fatalf("Fetch returned %q, %v", out, err)
+	}
+	if metrics.CacheHits.Value() != 1 || metrics.CacheMisses.Value() != 0 {
+		t.Errorf("counted %d hits and %d misses, want 1 and 0", metrics.CacheHits.Value(), metrics.CacheMisses.Value())
+	}
+}
+
+func TestEvictsOldCommits(t *testing.T) {
+	fs := &memFilesystem{}
+	c, err := NewCache("/cache", WithFilesystem(fs), WithMetrics(&Metrics{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generate := func() ([]byte, error) { return []byte("{}"), nil }
+	key := func(keychainCommit, trvsCommit string, isPro bool) CacheKey {
+		return CacheKey{KeychainCommit: keychainCommit, TrvsCommit: trvsCommit, App: "app", Environment: "production", IsPro: isPro, Format: "json"}
+	}
+
+	for _, k := range []CacheKey{
+		key("org1", "trvs1", false),
+		key("org2", "trvs1", false),
+		key("org2", "trvs2", false),
+		key("com1", "trvs1", true),
+	} {
+		if _, err := c.Fetch(k, generate); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.EvictTrvs("trvs1")
+	c.evictKeychain(false, "org2")
+
+	want := map[string]bool{
+		"/cache/org/org2/trvs1/" + path.Base(c.file(key("org2", "trvs1", false))): true,
+		"/cache/com/com1/trvs1/" + path.Base(c.file(key("com1", "trvs1", true))):  true,
+	}
+	for name := range fs.files {
+		if !want[name] {
+			t.Errorf("evicting left %s behind", name)
+		}
+	}
+	if len(c.entries) != 2 {
+		t.Errorf("evicting left %d entries in memory, want 2", len(c.entries))
+	}
+
+	// output of a run that started before the eviction isn't kept
+	if _, err := c.Fetch(key("org1", "trvs1", false), generate); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.files) != 2 || len(c.entries) != 2 {
+		t.Errorf("stale output was cached")
+	}
+}
@@ -0,0 +1,75 @@
+package trvs
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/travis-ci/trvs-operator/pkg/filesystem"
+	"github.com/travis-ci/trvs-operator/pkg/logging"
+)
+
+// Option configures an optional part of a Trvs or a Cache.
+type Option func(*options)
+
+type options struct {
+	fs       filesystem.Interface
+	metrics  *Metrics
+	redactor *logging.Redactor
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		fs:       filesystem.OS,
+		redactor: logging.Secrets,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.metrics == nil {
+		o.metrics = DefaultMetrics()
+	}
+	return o
+}
+
+// WithFilesystem sets the filesystem checkouts and cached output are kept on.
+// It defaults to filesystem.OS.
+func WithFilesystem(fs filesystem.Interface) Option {
+	return func(o *options) { o.fs = fs }
+}
+
+// WithMetrics sets what trvs runs and cache lookups are counted in. It
+// defaults to DefaultMetrics.
+func WithMetrics(m *Metrics) Option {
+	return func(o *options) { o.metrics = m }
+}
+
+// WithRedactor sets what secret values are redacted from trvs errors with.
+// It defaults to logging.Secrets, which is what the loggers use.
+func WithRedactor(r *logging.Redactor) Option {
+	return func(o *options) { o.redactor = r }
+}
+
+// Metrics counts what trvs does.
+type Metrics struct {
+	// Running is how many trvs commands are running right now.
+	Running     expvar.Int
+	CacheHits   expvar.Int
+	CacheMisses expvar.Int
+}
+
+var (
+	defaultMetrics Metrics
+	publishOnce    sync.Once
+)
+
+// DefaultMetrics returns the metrics published with expvar as trvs_running,
+// trvs_cache_hits and trvs_cache_misses. They are published the first time
+// they are asked for, and shared by everything using them.
+func DefaultMetrics() *Metrics {
+	publishOnce.Do(func() {
+		expvar.Publish("trvs_running", &defaultMetrics.Running)
+		expvar.Publish("trvs_cache_hits", &defaultMetrics.CacheHits)
+		expvar.Publish("trvs_cache_misses", &defaultMetrics.CacheMisses)
+	})
+	return &defaultMetrics
+}
@@ -0,0 +1,403 @@
+// Package trvs generates secret data by running trvs against snapshots of the
+// keychains.
+package trvs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+	"github.com/travis-ci/trvs-operator/pkg/backoff"
+	"github.com/travis-ci/trvs-operator/pkg/gitrepo"
+	"github.com/travis-ci/trvs-operator/pkg/keychain"
+	"github.com/travis-ci/trvs-operator/pkg/logging"
+)
+
+var trvsLog = logging.Subsystem("trvs")
+
+// maxStderrLength is how much of what trvs wrote to stderr ends up in errors.
+const maxStderrLength = 1024
+
+// New sets up trvs from repo, keeping its checkouts in dir. At most
+// concurrency trvs commands are run at the same time.
+func New(dir string, repo gitrepo.Interface, keychains keychain.Keychains, cache *Cache, concurrency int, opts ...Option) (*Trvs, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	t := &Trvs{
+		Path:      dir,
+		Repo:      repo,
+		Keychains: keychains,
+		Cache:     cache,
+		options:   newOptions(opts),
+		running:   make(chan struct{}, concurrency),
+	}
+
+	if err := t.initialize(); err != nil {
+		return nil, err
+	}
+
+	// drop output of keychain commits left behind by a previous run
+	cache.Evict(keychains.Org)
+	cache.Evict(keychains.Com)
+	keychains.OnUpdate(cache.Evict)
+
+	return t, nil
+}
+
+type Trvs struct {
+	Path      string
+	Repo      gitrepo.Interface
+	Keychains keychain.Keychains
+	Cache     *Cache
+
+	options
+
+	// mu guards the current checkout. Generating config holds a read lock for
+	// the duration of the trvs command, so a checkout is never swapped out or
+	// removed while it is in use.
+	mu      sync.RWMutex
+	commit  plumbing.Hash
+	current string
+
+	// running limits how many trvs commands run at the same time
+	running chan struct{}
+}
+
+func (t *Trvs) initialize() error {
+	if err := t.Repo.Open(); err != nil {
+		return err
+	}
+
+	if _, _, err := t.Repo.Sync(); err != nil {
+		return err
+	}
+	trvsLog.Info("initialized trvs repo")
+
+	head, err := t.Repo.Head()
+	if err != nil {
+		return err
+	}
+
+	if err := t.checkout(head, true); err != nil {
+		return err
+	}
+	trvsLog.Info("installed trvs dependencies")
+
+	return nil
+}
+
+func (t *Trvs) checkoutPath(h plumbing.Hash) string {
+	return path.Join(t.Path, "checkouts", h.String())
+}
+
+// Update pulls the latest trvs and, if it changed, switches generation over to
+// a fresh checkout of it. Dependencies are only reinstalled if Gemfile.lock
+// changed.
+func (t *Trvs) Update() (bool, error) {
+	_, head, err := t.Repo.Sync()
+	if err != nil {
+		return false, err
+	}
+
+	t.mu.RLock()
+	old := t.commit
+	t.mu.RUnlock()
+
+	if head == old {
+		return false, nil
+	}
+
+	changed, err := t.lockfileChanged(old, head)
+	if err != nil {
+		trvsLog.WithError(err).Warn("could not compare Gemfile.lock, reinstalling dependencies")
+		changed = true
+	}
+
+	if err := t.checkout(head, changed); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Watch updates trvs every d until ctx is done, calling handler whenever it
+// switches to a new checkout.
+func (t *Trvs) Watch(ctx context.Context, d time.Duration, handler func()) {
+	b := &backoff.Backoff{Min: 5 * time.Second, Max: 5 * time.Minute}
+	trvsLog.Info("watching trvs")
+
+	for {
+		updated, err := t.Update()
+		if err != nil {
+			if !backoff.Sleep(ctx, b.Next()) {
+				break
+			}
+			continue
+		}
+
+		b.Reset()
+		if updated {
+			handler()
+		}
+
+		if !backoff.Sleep(ctx, d) {
+			break
+		}
+	}
+
+	trvsLog.Info("stopped watching trvs")
+}
+
+// checkout writes a checkout of a trvs commit, installs its dependencies if
+// asked to, and then atomically makes it the one used to generate config.
+func (t *Trvs) checkout(h plumbing.Hash, installDeps bool) error {
+	entry := trvsLog.WithField("commit", h.String())
+	dir := t.checkoutPath(h)
+
+	if err := t.fs.MkdirAll(path.Dir(dir), 0755); err != nil {
+		return err
+	}
+
+	if err := t.fs.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	if err := t.Repo.Checkout(h, dir); err != nil {
+		entry.WithError(err).Error("could not check out trvs")
+		return err
+	}
+
+	if installDeps {
+		if err := t.installDeps(dir); err != nil {
+			entry.WithError(err).Error("could not install trvs dependencies")
+			t.fs.RemoveAll(dir)
+			return err
+		}
+		entry.Info("installed trvs dependencies")
+	}
+
+	t.mu.Lock()
+	old := t.current
+	t.commit = h
+	t.current = dir
+	t.mu.Unlock()
+
+	entry.Info("switched to new trvs checkout")
+
+	// nothing is generated by the old checkout anymore
+	t.Cache.EvictTrvs(h.String())
+
+	if old != "" && old != dir {
+		if err := t.fs.RemoveAll(old); err != nil {
+			entry.WithError(err).WithField("dir", old).Warn("could not remove old trvs checkout")
+		}
+	}
+
+	return nil
+}
+
+func (t *Trvs) lockfileChanged(from, to plumbing.Hash) (bool, error) {
+	fromHash, err := t.lockfileHash(from)
+	if err != nil {
+		return false, err
+	}
+
+	toHash, err := t.lockfileHash(to)
+	if err != nil {
+		return false, err
+	}
+
+	return fromHash != toHash, nil
+}
+
+func (t *Trvs) lockfileHash(h plumbing.Hash) (plumbing.Hash, error) {
+	commit, err := t.Repo.CommitObject(h)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	f, err := commit.File("Gemfile.lock")
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return f.Hash, nil
+}
+
+func (t *Trvs) installDeps(dir string) error {
+	cmd := exec.Command("bundle", "install")
+	cmd.Dir = dir
+	return cmd.Run()
+}
+
+// Generate produces the secret data for a spec. Everything is read from a
+// single snapshot of the keychains, whose commit is returned along with the
+// data.
+func (t *Trvs) Generate(spec v1.TrvsSecretSpec) (map[string][]byte, string, error) {
+	return t.generate(spec, false)
+}
+
+// Regenerate is like Generate, but always runs trvs instead of reusing cached
+// output.
+func (t *Trvs) Regenerate(spec v1.TrvsSecretSpec) (map[string][]byte, string, error) {
+	return t.generate(spec, true)
+}
+
+func (t *Trvs) generate(spec v1.TrvsSecretSpec, fresh bool) (map[string][]byte, string, error) {
+	var secrets map[string]interface{}
+	rawKeys := spec.RawKeys
+
+	snaps := t.Keychains.Snapshot()
+	defer snaps.Release()
+	snap := snaps.ForPro(spec.IsPro)
+
+	if spec.File != "" {
+		contents, err := snap.ReadFile(spec.File)
+		if err != nil {
+			return nil, "", err
+		}
+
+		rawKeys = true
+		secrets = make(map[string]interface{})
+		secrets[spec.Key] = contents
+	} else {
+		// generate JSON because it's easier to work with natively in Go
+		format := "json"
+		if spec.Key != "" {
+			// if we are just storing the bytes, use YAML
+			//
+			// add an option to the Spec if we need to customize this later, but for now,
+			// the only use case for this wants YAML.
+			format = "yaml"
+		}
+
+		out, err := t.generateConfig(snaps, spec, format, fresh)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if spec.Key != "" {
+			rawKeys = true
+			secrets = make(map[string]interface{})
+			secrets[spec.Key] = out
+		} else {
+			if err := json.Unmarshal(out, &secrets); err != nil {
+				return nil, "", outputError(err)
+			}
+		}
+	}
+
+	return transformSecretData(spec, secrets, rawKeys), snap.Commit, nil
+}
+
+// generateConfig runs `trvs generate-config` for the spec against the
+// snapshots, reusing the output of a previous run if neither repo has changed
+// since, unless fresh output is asked for.
+func (t *Trvs) generateConfig(snaps keychain.Snapshots, spec v1.TrvsSecretSpec, format string, fresh bool) ([]byte, error) {
+	// hold on to the current checkout until the command is done, so the output
+	// is cached under the commit it was actually generated with
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	key := CacheKey{
+		KeychainCommit: snaps.ForPro(spec.IsPro).Commit,
+		TrvsCommit:     t.commit.String(),
+		App:            spec.App,
+		Environment:    spec.Environment,
+		IsPro:          spec.IsPro,
+		Format:         format,
+	}
+
+	fetch := t.Cache.Fetch
+	if fresh {
+		fetch = t.Cache.Refresh
+	}
+
+	return fetch(key, func() ([]byte, error) {
+		keychainsDir, err := snaps.Link()
+		if err != nil {
+			return nil, err
+		}
+		defer t.fs.RemoveAll(keychainsDir)
+
+		var out, stderr bytes.Buffer
+		cmd := exec.Command(path.Join(t.current, "bin", "trvs"), "generate-config", "-n", "-f", format, "-a", spec.App, "-e", spec.Environment)
+		if spec.IsPro {
+			cmd.Args = append(cmd.Args, "--pro")
+		}
+		cmd.Env = append(os.Environ(), "TRAVIS_KEYCHAIN_DIR="+keychainsDir)
+		cmd.Stdout = &out
+		cmd.Stderr = &stderr
+
+		t.running <- struct{}{}
+		t.metrics.Running.Add(1)
+		err = cmd.Run()
+		t.metrics.Running.Add(-1)
+		<-t.running
+
+		if err != nil {
+			return nil, commandError(t.redactor, err, stderr.Bytes())
+		}
+
+		return out.Bytes(), nil
+	})
+}
+
+// commandError describes a failed trvs command by the end of what it wrote
+// to stderr, which is redacted first since trvs may have printed secret values.
+func commandError(redactor *logging.Redactor, err error, stderr []byte) error {
+	msg := redactor.Redact(strings.TrimSpace(string(stderr)))
+	if msg == "" {
+		return fmt.Errorf("trvs generate-config failed: %v", err)
+	}
+
+	if len(msg) > maxStderrLength {
+		msg = "..." + msg[len(msg)-maxStderrLength:]
+	}
+	return fmt.Errorf("trvs generate-config failed: %v: %s", err, msg)
+}
+
+// outputError describes why the output of trvs couldn't be decoded without
+// quoting any of it, as the JSON errors do.
+func outputError(err error) error {
+	if err, ok := err.(*json.SyntaxError); ok {
+		return fmt.Errorf("trvs output is not valid JSON at byte %d", err.Offset)
+	}
+	if err, ok := err.(*json.UnmarshalTypeError); ok {
+		return fmt.Errorf("trvs output is not a JSON object at byte %d", err.Offset)
+	}
+	return fmt.Errorf("trvs output is not a JSON object")
+}
+
+func transformSecretData(spec v1.TrvsSecretSpec, data map[string]interface{}, rawKeys bool) map[string][]byte {
+	newData := make(map[string][]byte)
+
+	for k, v := range data {
+		if !rawKeys {
+			if spec.Prefix != "" {
+				k = spec.Prefix + "_" + k
+			}
+			k = strings.ToUpper(k)
+		}
+
+		// K8s API handles base64 encoding the values, so just put the raw bytes in here
+		if bytes, ok := v.([]byte); ok {
+			newData[k] = bytes
+		} else {
+			newData[k] = []byte(fmt.Sprintf("%v", v))
+		}
+	}
+
+	return newData
+}
@@ -0,0 +1,52 @@
+package trvs
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/travis-ci/trvs-operator/pkg/logging"
+)
+
+const secret = "hunter2-supersecret"
+
+func TestCommandErrorIsRedacted(t *testing.T) {
+	redactor := &logging.Redactor{}
+	redactor.Set("test/trvs", map[string][]byte{"PASSWORD": []byte(secret)})
+
+	stderr := "config/app.yml: could not parse \"" + secret + "\"\n"
+	err := commandError(redactor, errors.New("exit status 1"), []byte(stderr))
+	if strings.Contains(err.Error(), secret) {
+		t.Fatalf("error contains the secret: %v", err)
+	}
+	if !strings.Contains(err.Error(), "could not parse") {
+		t.Fatalf("error lost what trvs said: %v", err)
+	}
+
+	// the secret is cut off after being redacted, never before
+	long := strings.Repeat("x", maxStderrLength-5) + secret
+	err = commandError(redactor, errors.New("exit status 1"), []byte(long))
+	if strings.Contains(err.Error(), secret[:8]) {
+		t.Fatalf("truncated error contains part of the secret: %v", err)
+	}
+}
+
+func TestOutputErrorQuotesNothing(t *testing.T) {
+	for _, out := range []string{
+		secret,
+		`"` + secret + `"`,
+		`[1, 2]`,
+		`{"PASSWORD": "` + secret + `"`,
+	} {
+		var secrets map[string]interface{}
+		err := json.Unmarshal([]byte(out), &secrets)
+		if err == nil {
+			t.Fatalf("decoding %q succeeded", out)
+		}
+
+		if msg := outputError(err).Error(); strings.ContainsAny(msg, `'"`) || strings.Contains(msg, secret) {
+			t.Errorf("error for %q quotes the output: %s", out, msg)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Package trvssecret holds what the operator and the tools inspecting its
+// secrets agree on: the annotations and labels it sets, how revisions are
+// named and which workloads use a TrvsSecret. It only depends on the API
+// types, so tools can use it without pulling in the controller.
+package trvssecret
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+)
+
+const (
+	// KeychainCommitAnnotation records the keychain commit a secret's data
+	// was generated from.
+	KeychainCommitAnnotation = "travisci.com/keychain-commit"
+
+	// ManagedKeysAnnotation lists the keys of a secret that were generated by
+	// the operator, as opposed to kept from before it was adopted.
+	ManagedKeysAnnotation = "travisci.com/managed-keys"
+
+	// DataHashAnnotation records a hash of the data the operator last wrote
+	// to a secret, so edits made by anyone else can be detected. Revision
+	// secrets don't have it, since their name already says what they hold.
+	DataHashAnnotation = "travisci.com/data-hash"
+
+	// ResyncAtAnnotation forces a fresh keychain fetch and regeneration of a
+	// TrvsSecret whenever its value changes. Any value works, but a timestamp
+	// makes the most sense.
+	ResyncAtAnnotation = "travisci.com/resync-at"
+
+	// WorkloadSecretsAnnotation opts a Deployment, StatefulSet or DaemonSet
+	// into having its references to immutable secrets kept up to date. It
+	// lists the names of the TrvsSecrets to follow, separated by commas.
+	WorkloadSecretsAnnotation = "travisci.com/trvs-secrets"
+)
+
+const (
+	// OwnerLabel names the TrvsSecret a secret was generated for.
+	OwnerLabel = "travisci.com/trvs-secret"
+
+	// HistoryOfLabel names the TrvsSecret a revision secret belongs to.
+	// Revision secrets deliberately don't have the managed-by label, so the
+	// sweeper leaves them to the garbage collector.
+	HistoryOfLabel = "travisci.com/history-of"
+)
+
+// DataHash hashes secret data independently of key order.
+func DataHash(data map[string][]byte) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		// length-prefix everything so different data can't hash the same
+		binary.Write(h, binary.BigEndian, uint64(len(k)))
+		h.Write([]byte(k))
+		binary.Write(h, binary.BigEndian, uint64(len(data[k])))
+		h.Write(data[k])
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Revision names a version of generated data by its hash.
+func Revision(generated map[string][]byte) string {
+	return DataHash(generated)[:10]
+}
+
+// RevisionSecretName is the name of the secret that keeps revision rev of the
+// data of ts.
+func RevisionSecretName(ts *travisv1.TrvsSecret, rev string) string {
+	return ts.Name + "-" + rev
+}
@@ -0,0 +1,78 @@
+package trvssecret
+
+import (
+	"strings"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	travisv1 "github.com/travis-ci/trvs-operator/pkg/apis/travisci/v1"
+)
+
+// FollowsTrvsSecret reports whether a workload opted into following the
+// secrets of ts with the WorkloadSecretsAnnotation.
+func FollowsTrvsSecret(meta metav1.ObjectMeta, ts *travisv1.TrvsSecret) bool {
+	for _, name := range strings.Split(meta.Annotations[WorkloadSecretsAnnotation], ",") {
+		if strings.TrimSpace(name) == ts.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// ReferencesSecrets reports whether a pod spec refers to any of the named
+// secrets.
+func ReferencesSecrets(spec *v1.PodSpec, names map[string]bool) bool {
+	return RewriteSecretRefs(spec.DeepCopy(), names, "")
+}
+
+// RewriteSecretRefs replaces references to any of the named secrets in a pod
+// spec with current. It reports whether anything was changed.
+func RewriteSecretRefs(spec *v1.PodSpec, names map[string]bool, current string) bool {
+	changed := false
+	replace := func(name *string) {
+		if names[*name] && *name != current {
+			*name = current
+			changed = true
+		}
+	}
+
+	for i := range spec.Volumes {
+		vol := &spec.Volumes[i]
+		if vol.Secret != nil {
+			replace(&vol.Secret.SecretName)
+		}
+		if vol.Projected != nil {
+			for j := range vol.Projected.Sources {
+				if src := vol.Projected.Sources[j].Secret; src != nil {
+					replace(&src.Name)
+				}
+			}
+		}
+	}
+
+	containers := append([]*v1.Container{}, containerRefs(spec.InitContainers)...)
+	containers = append(containers, containerRefs(spec.Containers)...)
+	for _, container := range containers {
+		for i := range container.Env {
+			if from := container.Env[i].ValueFrom; from != nil && from.SecretKeyRef != nil {
+				replace(&from.SecretKeyRef.Name)
+			}
+		}
+		for i := range container.EnvFrom {
+			if ref := container.EnvFrom[i].SecretRef; ref != nil {
+				replace(&ref.Name)
+			}
+		}
+	}
+
+	return changed
+}
+
+func containerRefs(containers []v1.Container) []*v1.Container {
+	refs := make([]*v1.Container, len(containers))
+	for i := range containers {
+		refs[i] = &containers[i]
+	}
+	return refs
+}